@@ -1,5 +1,21 @@
 package tengo2lua
 
+// Builtin is a Tengo builtin function implemented in Lua.
+type Builtin struct {
+	// Name is the name of the function in Tengo code.
+	Name string
+
+	// Code is a Lua function expression, e.g. "function(a, b) ... end". In
+	// the code, "$name" refers to the helper or the builtin function 'name'.
+	Code string
+
+	// Deps lists the helpers ("add", "iter", "slice", and "div" and "shr" on
+	// Lua 5.3+) and the builtin functions the code refers to.
+	Deps []string
+}
+
+// builtinFunctions are the code of the Tengo builtin functions. Like the
+// helpers, they are function expressions.
 var builtinFunctions = map[string]string{
 	"len": `function(v)
     	if v.__a then
@@ -7,9 +23,13 @@ var builtinFunctions = map[string]string{
     	elseif type(v) == "string" then
 			return string.len(v)
 		else
-        	__n = 0
-        	for _ in pairs(v) do __n = __n + 1 end
-        	return __n
+        	local n = 0
+        	for _ in pairs(v) do n = n + 1 end
+        	return n
     	end
 	end`,
 }
+
+// builtinDeps lists the helpers and the builtin functions each builtin
+// function calls.
+var builtinDeps = map[string][]string{}
@@ -0,0 +1,281 @@
+package tengo2lua
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/d5/tengo/compiler/ast"
+)
+
+// CallRule rewrites the calls to a function into a Lua expression.
+type CallRule struct {
+	// Callee is the called function: a name (e.g. "max") or a selector
+	// path (e.g. "log.info"). The rule does not apply where the script
+	// defines a variable with the name of the callee (or of its first
+	// element).
+	Callee string
+
+	// Template is a Lua expression. "$1", "$2", ... are replaced by the
+	// arguments of the call and "$*" by the list of all the arguments, e.g.
+	// "math.max($1, $2)" or "logger:info(string.format($*))". A call must
+	// have as many arguments as the template uses, and no more unless the
+	// template uses "$*".
+	Template string
+}
+
+// templateArg matches the placeholders of the arguments in call templates.
+var templateArg = regexp.MustCompile(`\$([0-9]+|\*)`)
+
+// templateAll is the index of the "$*" placeholder in callTemplate.args.
+const templateAll = -1
+
+// callTemplate is a parsed call rule or a template of a hook.
+type callTemplate struct {
+	rule *CallRule
+
+	// parts are the code between the placeholders, and args are the
+	// placeholders: the indexes of the arguments (0-based) or templateAll.
+	parts []string
+	args  []int
+
+	// numArgs is the number of arguments the template uses, and variadic
+	// is true if it uses "$*".
+	numArgs  int
+	variadic bool
+
+	// conditional is true if the template may not evaluate its code exactly
+	// once, from left to right (e.g. "$1 and $2").
+	conditional bool
+
+	// names are the global names the template refers to.
+	names []string
+}
+
+// newCallTemplate parses a call rule.
+func newCallTemplate(rule *CallRule, minify bool) (*callTemplate, error) {
+	for _, name := range strings.Split(rule.Callee, ".") {
+		if !isLuaName(name) {
+			return nil, fmt.Errorf("invalid callee '%s' of call rule", rule.Callee)
+		}
+	}
+
+	tmpl, err := parseTemplate(rule.Template, minify)
+	if err != nil {
+		return nil, fmt.Errorf("%s of call rule '%s'", err.Error(), rule.Callee)
+	}
+	tmpl.rule = rule
+
+	return tmpl, nil
+}
+
+// conditionalKeywords are the keywords of the Lua expressions whose operands
+// are evaluated conditionally, or any number of times.
+var conditionalKeywords = map[string]bool{
+	"and": true, "or": true, "function": true, "while": true, "for": true, "repeat": true,
+}
+
+// parseTemplate parses a Lua template.
+func parseTemplate(code string, minify bool) (*callTemplate, error) {
+	tmpl := &callTemplate{}
+	if minify {
+		code = minifyLua(code)
+	}
+
+	last := 0
+	for _, loc := range templateArg.FindAllStringSubmatchIndex(code, -1) {
+		tmpl.parts = append(tmpl.parts, code[last:loc[0]])
+		last = loc[1]
+
+		if code[loc[2]:loc[3]] == "*" {
+			tmpl.args = append(tmpl.args, templateAll)
+			tmpl.variadic = true
+			continue
+		}
+		n, err := strconv.Atoi(code[loc[2]:loc[3]])
+		if err != nil || n < 1 {
+			return nil, fmt.Errorf("invalid argument '%s' in template", code[loc[0]:loc[1]])
+		}
+		tmpl.args = append(tmpl.args, n-1)
+		if n > tmpl.numArgs {
+			tmpl.numArgs = n
+		}
+	}
+	tmpl.parts = append(tmpl.parts, code[last:])
+
+	// the names that are not fields or method names
+	afterDot := false
+	for _, tok := range luaTokenize(templateArg.ReplaceAllString(code, " nil ")) {
+		if tok.kind == tokSpace {
+			continue
+		}
+		if tok.kind == tokName && !afterDot && !luaKeywords[tok.text] {
+			tmpl.names = append(tmpl.names, tok.text)
+		}
+		if tok.kind == tokName && conditionalKeywords[tok.text] {
+			tmpl.conditional = true
+		}
+		afterDot = tok.text == "." || tok.text == ":"
+	}
+
+	return tmpl, nil
+}
+
+// callRule returns the call rule that applies to a callee, or nil.
+func (t *Transpiler) callRule(callee ast.Expr) *callTemplate {
+	if len(t.callRules) == 0 {
+		return nil
+	}
+
+	var path []string
+	for {
+		switch expr := callee.(type) {
+		case *ast.SelectorExpr:
+			sel, ok := expr.Sel.(*ast.StringLit)
+			if !ok {
+				return nil
+			}
+			path = append([]string{sel.Value}, path...)
+			callee = expr.Expr
+			continue
+		case *ast.Ident:
+			if _, _, defined := t.symbolTable.Resolve(expr.Name); defined {
+				return nil
+			}
+			path = append([]string{expr.Name}, path...)
+			return t.callRules[strings.Join(path, ".")]
+		}
+		return nil
+	}
+}
+
+// convertRuleCall converts a call rewritten by a call rule.
+func (t *Transpiler) convertRuleCall(node *ast.CallExpr, tmpl *callTemplate) (luaExpr, error) {
+	name := tmpl.rule.Callee
+	if len(node.Args) < tmpl.numArgs {
+		return nil, t.error(node, "not enough arguments in call to '%s': want %d, got %d", name, tmpl.numArgs, len(node.Args))
+	}
+	if len(node.Args) > tmpl.numArgs && !tmpl.variadic {
+		return nil, t.error(node, "too many arguments in call to '%s': want %d, got %d", name, tmpl.numArgs, len(node.Args))
+	}
+
+	if global := t.shadowedName(tmpl); global != "" {
+		return nil, t.error(node, "call rule '%s' refers to '%s', which is shadowed by a variable", name, global)
+	}
+
+	args, err := t.convertOperands(node.Args...)
+	if err != nil {
+		return nil, err
+	}
+
+	return tmpl.apply(args), nil
+}
+
+// shadowedName returns the first global name of the template that is
+// shadowed by a variable of the script, or "".
+func (t *Transpiler) shadowedName(tmpl *callTemplate) string {
+	for _, global := range tmpl.names {
+		if _, _, shadowed := t.symbolTable.Resolve(global); shadowed && !needsMangling(global) {
+			return global
+		}
+	}
+	return ""
+}
+
+// apply substitutes the arguments in the template. The arguments are
+// evaluated once, in order: if the template does not use each argument with
+// side effects exactly once and in order, they are passed to a function that
+// evaluates the template.
+//
+//	(function(__a1__, __a2__) return (template) end)(arg1, arg2)
+func (tmpl *callTemplate) apply(args []luaExpr) luaExpr {
+	if tmpl.inlinable(args) {
+		return tmpl.expand(args)
+	}
+
+	fn := &luaFunction{}
+	var params []luaExpr
+	for idx := range args {
+		param := fmt.Sprintf("__a%d__", idx+1)
+		fn.params = append(fn.params, param)
+		params = append(params, &luaName{name: param})
+	}
+	fn.body = luaBlock{&luaReturn{values: []luaExpr{&luaParen{expr: tmpl.expand(params)}}}}
+
+	return &luaCall{fn: fn, args: args}
+}
+
+// inlinable returns true if the arguments can be substituted in the template:
+// the arguments that may have side effects must be used exactly once, in
+// order, and the variables must be read between the same arguments with side
+// effects as in the call. A conditional template cannot have arguments with
+// side effects.
+func (tmpl *callTemplate) inlinable(args []luaExpr) bool {
+	var used []int
+	for _, idx := range tmpl.args {
+		if idx != templateAll {
+			used = append(used, idx)
+			continue
+		}
+		for idx := range args {
+			used = append(used, idx)
+		}
+	}
+
+	// before[idx] is the number of impure arguments before the argument idx
+	before := make([]int, len(args))
+	impure := 0
+	for idx, arg := range args {
+		before[idx] = impure
+		if _, isName := arg.(*luaName); !isName && !isPure(arg) {
+			impure++
+		}
+	}
+
+	if tmpl.conditional && impure > 0 {
+		return false
+	}
+
+	evaluated := 0
+	for _, idx := range used {
+		if isPure(args[idx]) {
+			continue
+		}
+		if before[idx] != evaluated {
+			return false
+		}
+		if _, isName := args[idx].(*luaName); !isName {
+			evaluated++
+		}
+	}
+
+	return evaluated == impure
+}
+
+// isPure returns true if evaluating the expression has no side effects and
+// does not depend on them.
+func isPure(expr luaExpr) bool {
+	switch expr.(type) {
+	case *luaLiteral, *luaStringLit, *luaFunction:
+		return true
+	}
+	return false
+}
+
+// expand substitutes the arguments in the template.
+func (tmpl *callTemplate) expand(args []luaExpr) *luaTemplate {
+	out := &luaTemplate{names: tmpl.names}
+	for idx, part := range tmpl.parts {
+		out.parts = append(out.parts, part)
+		if idx == len(tmpl.args) {
+			break
+		}
+		if argIdx := tmpl.args[idx]; argIdx != templateAll {
+			out.args = append(out.args, []luaExpr{args[argIdx]})
+		} else {
+			out.args = append(out.args, args)
+		}
+	}
+	return out
+}
@@ -0,0 +1,366 @@
+package tengo2lua
+
+import (
+	"math"
+	"strconv"
+
+	"github.com/d5/tengo/compiler/ast"
+	"github.com/d5/tengo/compiler/token"
+	"github.com/d5/tengo/objects"
+)
+
+// foldConstants evaluates the constant expressions of the Tengo AST and
+// removes the branches and the loops whose conditions are constant.
+//
+// Constant expressions are evaluated by the Tengo runtime objects, so the
+// results follow Tengo semantics (e.g. integer division truncates and "1 ==
+// 1.0" is false). The conditions and the logical operators follow the Lua
+// truthiness of the converted code instead: only undefined and false are
+// falsy. A folded literal takes the position of the expression it
+// replaces. Expressions that would fail at runtime (e.g. division by zero) and
+// results that have no exact Lua literal are left as they are.
+func (t *Transpiler) foldConstants(file *ast.File) {
+	file.Stmts = t.foldStmts(file.Stmts)
+}
+
+func (t *Transpiler) foldStmts(stmts []ast.Stmt) []ast.Stmt {
+	var out []ast.Stmt
+	for _, stmt := range stmts {
+		if stmt = t.foldStmt(stmt); stmt != nil {
+			out = append(out, stmt)
+		}
+	}
+	return out
+}
+
+// foldStmt folds the expressions of a statement. It returns nil if the
+// statement has no effect.
+func (t *Transpiler) foldStmt(stmt ast.Stmt) ast.Stmt {
+	switch node := stmt.(type) {
+	case *ast.BlockStmt:
+		node.Stmts = t.foldStmts(node.Stmts)
+
+	case *ast.ExprStmt:
+		node.Expr = t.foldExpr(node.Expr)
+
+	case *ast.IncDecStmt:
+		node.Expr = t.foldExpr(node.Expr)
+
+	case *ast.AssignStmt:
+		t.foldExprs(node.LHS)
+		t.foldExprs(node.RHS)
+
+	case *ast.ReturnStmt:
+		if node.Result != nil {
+			node.Result = t.foldExpr(node.Result)
+		}
+
+	case *ast.ExportStmt:
+		node.Result = t.foldExpr(node.Result)
+
+	case *ast.IfStmt:
+		if node.Init != nil {
+			node.Init = t.foldStmt(node.Init)
+		}
+		node.Cond = t.foldExpr(node.Cond)
+		t.foldStmt(node.Body)
+		if node.Else != nil {
+			node.Else = t.foldStmt(node.Else)
+		}
+
+		cond, isConst := constValue(node.Cond)
+		if !isConst {
+			return node
+		}
+
+		// the branch taken is the body of "if true { ... }", which is
+		// lowered without the condition. The init statement stays in the
+		// same scope.
+		taken := node.Body
+		if luaFalsy(cond) {
+			switch els := node.Else.(type) {
+			case nil:
+				taken = &ast.BlockStmt{LBrace: node.Body.RBrace, RBrace: node.Body.RBrace}
+			case *ast.BlockStmt:
+				taken = els
+			default:
+				if node.Init == nil {
+					return els
+				}
+				taken = &ast.BlockStmt{Stmts: []ast.Stmt{els}, LBrace: els.Pos(), RBrace: els.End()}
+			}
+		}
+
+		if node.Init == nil && len(taken.Stmts) == 0 {
+			return nil
+		}
+
+		return &ast.IfStmt{
+			IfPos: node.IfPos,
+			Init:  node.Init,
+			Cond:  &ast.BoolLit{Value: true, ValuePos: node.Cond.Pos(), Literal: "true"},
+			Body:  taken,
+		}
+
+	case *ast.ForStmt:
+		if node.Init != nil {
+			node.Init = t.foldStmt(node.Init)
+		}
+		if node.Cond != nil {
+			node.Cond = t.foldExpr(node.Cond)
+		}
+		if node.Post != nil {
+			node.Post = t.foldStmt(node.Post)
+		}
+		t.foldStmt(node.Body)
+
+		cond, isConst := constValue(node.Cond)
+		if !isConst {
+			return node
+		}
+
+		if !luaFalsy(cond) {
+			node.Cond = nil
+			return node
+		}
+
+		// the loop body is never executed
+		if node.Init == nil {
+			return nil
+		}
+
+		return &ast.IfStmt{
+			IfPos: node.ForPos,
+			Init:  node.Init,
+			Cond:  &ast.BoolLit{Value: true, ValuePos: node.Cond.Pos(), Literal: "true"},
+			Body:  &ast.BlockStmt{LBrace: node.Body.LBrace, RBrace: node.Body.LBrace},
+		}
+
+	case *ast.ForInStmt:
+		node.Iterable = t.foldExpr(node.Iterable)
+		t.foldStmt(node.Body)
+	}
+
+	return stmt
+}
+
+func (t *Transpiler) foldExprs(exprs []ast.Expr) {
+	for idx, expr := range exprs {
+		exprs[idx] = t.foldExpr(expr)
+	}
+}
+
+// foldExpr folds the constant subexpressions of an expression and returns
+// the folded expression.
+func (t *Transpiler) foldExpr(expr ast.Expr) ast.Expr {
+	switch node := expr.(type) {
+	case *ast.ParenExpr:
+		node.Expr = t.foldExpr(node.Expr)
+		if _, isConst := constValue(node.Expr); isConst {
+			return node.Expr
+		}
+
+	case *ast.UnaryExpr:
+		node.Expr = t.foldExpr(node.Expr)
+		if operand, isConst := constValue(node.Expr); isConst {
+			if result, ok := foldUnary(node.Token, operand); ok {
+				return t.constLiteral(node, result)
+			}
+		}
+
+	case *ast.BinaryExpr:
+		node.LHS = t.foldExpr(node.LHS)
+		node.RHS = t.foldExpr(node.RHS)
+
+		left, isConst := constValue(node.LHS)
+		if !isConst {
+			return node
+		}
+
+		// '&&' and '||' produce one of their operands
+		switch node.Token {
+		case token.LAnd:
+			if luaFalsy(left) {
+				return node.LHS
+			}
+			return node.RHS
+		case token.LOr:
+			if luaFalsy(left) {
+				return node.RHS
+			}
+			return node.LHS
+		}
+
+		if right, isConst := constValue(node.RHS); isConst {
+			if result, ok := foldBinary(node.Token, left, right); ok {
+				return t.constLiteral(node, result)
+			}
+		}
+
+	case *ast.CondExpr:
+		node.Cond = t.foldExpr(node.Cond)
+		node.True = t.foldExpr(node.True)
+		node.False = t.foldExpr(node.False)
+
+		if cond, isConst := constValue(node.Cond); isConst {
+			if luaFalsy(cond) {
+				return node.False
+			}
+			return node.True
+		}
+
+	case *ast.CallExpr:
+		node.Func = t.foldExpr(node.Func)
+		t.foldExprs(node.Args)
+
+	case *ast.IndexExpr:
+		node.Expr = t.foldExpr(node.Expr)
+		node.Index = t.foldExpr(node.Index)
+
+	case *ast.SliceExpr:
+		node.Expr = t.foldExpr(node.Expr)
+		if node.Low != nil {
+			node.Low = t.foldExpr(node.Low)
+		}
+		if node.High != nil {
+			node.High = t.foldExpr(node.High)
+		}
+
+	case *ast.SelectorExpr:
+		node.Expr = t.foldExpr(node.Expr)
+
+	case *ast.ArrayLit:
+		t.foldExprs(node.Elements)
+
+	case *ast.MapLit:
+		for _, elem := range node.Elements {
+			elem.Value = t.foldExpr(elem.Value)
+		}
+
+	case *ast.FuncLit:
+		t.foldStmt(node.Body)
+
+	case *ast.ErrorExpr:
+		node.Expr = t.foldExpr(node.Expr)
+
+	case *ast.ImmutableExpr:
+		node.Expr = t.foldExpr(node.Expr)
+	}
+
+	return expr
+}
+
+// luaFalsy returns true if the value is falsy in Lua: the converted
+// conditions and logical operators treat 0 and "" as true, unlike Tengo.
+func luaFalsy(value objects.Object) bool {
+	switch value := value.(type) {
+	case *objects.Undefined:
+		return true
+	case *objects.Bool:
+		return value.IsFalsy()
+	}
+	return false
+}
+
+// constValue returns the value of a literal expression.
+func constValue(expr ast.Expr) (objects.Object, bool) {
+	switch expr := expr.(type) {
+	case *ast.IntLit:
+		return &objects.Int{Value: expr.Value}, true
+	case *ast.FloatLit:
+		return &objects.Float{Value: expr.Value}, true
+	case *ast.StringLit:
+		return &objects.String{Value: expr.Value}, true
+	case *ast.BoolLit:
+		if expr.Value {
+			return objects.TrueValue, true
+		}
+		return objects.FalseValue, true
+	case *ast.UndefinedLit:
+		return objects.UndefinedValue, true
+	}
+
+	return nil, false
+}
+
+func foldUnary(op token.Token, operand objects.Object) (objects.Object, bool) {
+	switch op {
+	case token.Not:
+		if luaFalsy(operand) {
+			return objects.TrueValue, true
+		}
+		return objects.FalseValue, true
+	case token.Sub:
+		switch operand := operand.(type) {
+		case *objects.Int:
+			return &objects.Int{Value: -operand.Value}, true
+		case *objects.Float:
+			return &objects.Float{Value: -operand.Value}, true
+		}
+	case token.Add:
+		switch operand.(type) {
+		case *objects.Int, *objects.Float:
+			return operand, true
+		}
+	case token.Xor:
+		if operand, ok := operand.(*objects.Int); ok {
+			return &objects.Int{Value: ^operand.Value}, true
+		}
+	}
+
+	return nil, false
+}
+
+func foldBinary(op token.Token, left, right objects.Object) (objects.Object, bool) {
+	switch op {
+	case token.Equal, token.NotEqual:
+		if left.Equals(right) == (op == token.Equal) {
+			return objects.TrueValue, true
+		}
+		return objects.FalseValue, true
+	case token.Quo, token.Rem:
+		// integer division by zero is a runtime error
+		if right, ok := right.(*objects.Int); ok && right.Value == 0 {
+			return nil, false
+		}
+	}
+
+	result, err := left.BinaryOp(op, right)
+	if err != nil {
+		return nil, false
+	}
+
+	return result, true
+}
+
+// constLiteral returns the literal of a folded value at the position of the
+// expression. The expression is returned unchanged if the value cannot be
+// written as a Lua literal of the target.
+func (t *Transpiler) constLiteral(expr ast.Expr, value objects.Object) ast.Expr {
+	pos := expr.Pos()
+
+	switch value := value.(type) {
+	case *objects.Int:
+		// math.mininteger has no literal
+		if value.Value == math.MinInt64 {
+			return expr
+		}
+		if !t.options.Target.hasIntegers() && (value.Value > maxExactInt || value.Value < -maxExactInt) {
+			return expr
+		}
+		return &ast.IntLit{Value: value.Value, ValuePos: pos, Literal: strconv.FormatInt(value.Value, 10)}
+	case *objects.Float:
+		if math.IsInf(value.Value, 0) || math.IsNaN(value.Value) {
+			return expr
+		}
+		return &ast.FloatLit{Value: value.Value, ValuePos: pos, Literal: strconv.FormatFloat(value.Value, 'g', -1, 64)}
+	case *objects.String:
+		return &ast.StringLit{Value: value.Value, ValuePos: pos, Literal: strconv.Quote(value.Value)}
+	case *objects.Bool:
+		return &ast.BoolLit{Value: !value.IsFalsy(), ValuePos: pos, Literal: value.String()}
+	case *objects.Undefined:
+		return &ast.UndefinedLit{TokenPos: pos}
+	}
+
+	return expr
+}
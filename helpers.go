@@ -1,18 +1,32 @@
 package tengo2lua
 
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+)
+
 type helper int
 
 const (
 	helperStringConcat helper = iota
 	helperIterator
 	helperSlicing
+	helperDivision
+	helperShiftRight
 )
 
+// helpers are the code of the helper functions. Helpers are function
+// expressions; "$name" refers to the helper or the builtin function 'name'.
 var helpers = map[helper]string{
 	// string concatenation operator
-	helperStringConcat: `getmetatable("").__add=function(a,b) return a..b end`,
+	helperStringConcat: `function(a, b)
+		if type(a) == "string" then return a .. b end
+		return a + b
+	end`,
 	// iterator
-	helperIterator: `function __iter__(v)
+	helperIterator: `function(v)
     	if v.__a then
         	local idx = 0
 	        return function()
@@ -27,7 +41,7 @@ var helpers = map[helper]string{
     	end
 	end`,
 	// slicing operator
-	helperSlicing: `function __slice__(v, l, h)
+	helperSlicing: `function(v, l, h)
     	if v.__a then
 			if l >= h then return {[0]=nil, __a=true} end
 			return {[0]=nil, __a=true}
@@ -35,4 +49,153 @@ var helpers = map[helper]string{
         	return string.sub(v, l+1, h)
     	end
 	end`,
+	// division operator (Lua 5.3+): integer division truncates toward zero
+	helperDivision: `function(a, b)
+		if math.type(a) == "integer" and math.type(b) == "integer" then
+			local q = a // b
+			if q < 0 and q * b ~= a then q = q + 1 end
+			return q
+		end
+		return a / b
+	end`,
+	// arithmetic right shift operator (Lua 5.3+)
+	helperShiftRight: `function(a, b)
+		if b >= 63 then
+			if a < 0 then return -1 else return 0 end
+		end
+		return a // (1 << b)
+	end`,
+}
+
+// helperNames are the names of the helpers. They identify the helpers in the
+// dependencies of the prelude.
+var helperNames = map[helper]string{
+	helperStringConcat: "add",
+	helperIterator:     "iter",
+	helperSlicing:      "slice",
+	helperDivision:     "div",
+	helperShiftRight:   "shr",
+}
+
+// helperDeps lists the helpers and the builtin functions each helper calls.
+var helperDeps = map[helper][]string{}
+
+// helperSupported returns true if the helper can be used with the target.
+func helperSupported(h helper, target LuaVersion) bool {
+	switch h {
+	case helperDivision, helperShiftRight:
+		return target.hasIntegers()
+	}
+	return true
+}
+
+// preludeFunc is a function of the prelude: a helper or a builtin function.
+type preludeFunc struct {
+	code    string
+	deps    []string
+	builtin bool
+	custom  bool
+}
+
+// newPrelude returns the helpers supported by the target and the builtin
+// functions, including the custom ones of the options, by name.
+func newPrelude(opts *Options) (map[string]*preludeFunc, error) {
+	funcs := make(map[string]*preludeFunc)
+	for h, name := range helperNames {
+		if helperSupported(h, opts.Target) {
+			funcs[name] = &preludeFunc{code: helpers[h], deps: helperDeps[h]}
+		}
+	}
+	for name, code := range builtinFunctions {
+		funcs[name] = &preludeFunc{code: code, deps: builtinDeps[name], builtin: true}
+	}
+
+	for _, b := range opts.Builtins {
+		if !isLuaName(b.Name) && !luaKeywords[b.Name] {
+			return nil, fmt.Errorf("invalid builtin function name '%s'", b.Name)
+		}
+		if fn, ok := funcs[b.Name]; ok && !fn.builtin {
+			return nil, fmt.Errorf("builtin function name '%s' is used by a helper", b.Name)
+		}
+		funcs[b.Name] = &preludeFunc{code: b.Code, deps: b.Deps, builtin: true, custom: true}
+	}
+
+	for _, b := range opts.Builtins {
+		for _, dep := range b.Deps {
+			if _, ok := funcs[dep]; !ok {
+				return nil, fmt.Errorf("unknown dependency '%s' of builtin function '%s'", dep, b.Name)
+			}
+		}
+	}
+
+	return funcs, nil
+}
+
+// preludeNames returns the names of the used helpers and builtin functions:
+// the helpers come first, in the order of their declaration, followed by the
+// builtin functions in alphabetical order.
+func preludeNames(helpersUsed map[helper]bool, builtinsUsed map[string]bool) []string {
+	var used []int
+	for h, isUsed := range helpersUsed {
+		if isUsed {
+			used = append(used, int(h))
+		}
+	}
+	sort.Ints(used)
+
+	var names []string
+	for _, h := range used {
+		names = append(names, helperNames[helper(h)])
+	}
+
+	var builtins []string
+	for name, isUsed := range builtinsUsed {
+		if isUsed {
+			builtins = append(builtins, name)
+		}
+	}
+	sort.Strings(builtins)
+
+	return append(names, builtins...)
+}
+
+// preludeRef matches the references to the prelude functions in their code.
+// Only the references to the dependencies of a function are replaced.
+var preludeRef = regexp.MustCompile(`\$[A-Za-z_][A-Za-z0-9_]*`)
+
+// preludeCode returns the code of the prelude functions and of their
+// dependencies. The functions are defined as local variables named by
+// luaName. Each function is defined after its dependencies, and the order
+// only depends on the order of the names.
+func preludeCode(funcs map[string]*preludeFunc, names []string, luaName func(name string) string) string {
+	var out strings.Builder
+	added := make(map[string]bool)
+
+	var add func(name string)
+	add = func(name string) {
+		if added[name] {
+			return
+		}
+		added[name] = true
+
+		fn := funcs[name]
+		for _, dep := range fn.deps {
+			add(dep)
+		}
+		code := preludeRef.ReplaceAllStringFunc(fn.code, func(ref string) string {
+			for _, dep := range fn.deps {
+				if dep == ref[1:] {
+					return luaName(dep)
+				}
+			}
+			return ref
+		})
+		out.WriteString("local " + luaName(name) + " = " + code + "\n")
+	}
+
+	for _, name := range names {
+		add(name)
+	}
+
+	return out.String()
 }
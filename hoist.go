@@ -0,0 +1,373 @@
+package tengo2lua
+
+import (
+	"fmt"
+
+	"github.com/d5/tengo/compiler/ast"
+	"github.com/d5/tengo/compiler/token"
+)
+
+// hoistState collects the statements that must run before the expression of
+// the current statement is evaluated. Expressions that Lua cannot express
+// directly (e.g. a conditional expression with a possibly falsy value) are
+// hoisted into these statements and replaced by a temporary variable.
+type hoistState struct {
+	root ast.Expr
+	pre  luaBlock
+
+	// evaluated are the operands that are evaluated before the hoisted
+	// statements (see convertOperands)
+	evaluated map[ast.Node]bool
+}
+
+// convertHoisted converts an expression that is evaluated exactly once, right
+// before the statement that contains it. It returns the hoisted statements
+// separately from the converted expression.
+func (t *Transpiler) convertHoisted(expr ast.Expr) (luaBlock, luaExpr, error) {
+	prev := t.hoist
+	t.hoist = &hoistState{root: expr, evaluated: make(map[ast.Node]bool)}
+	defer func() { t.hoist = prev }()
+
+	out, err := t.convertExpr(expr)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return t.hoist.pre, out, nil
+}
+
+// convertConditional converts an expression that may not be evaluated at all
+// (e.g. the right-hand side of '&&'). Nothing can be hoisted out of it.
+func (t *Transpiler) convertConditional(expr ast.Expr) (luaExpr, error) {
+	prev := t.hoist
+	t.hoist = nil
+	defer func() { t.hoist = prev }()
+
+	return t.convertExpr(expr)
+}
+
+// canHoist returns true if the expression can be evaluated before the rest of
+// the statement without changing the behavior of the program: the parts of
+// the statement evaluated before it must already be evaluated into temporary
+// variables, or must not call functions (or be converted by hooks) and, if the
+// expression calls functions, must not read variables.
+func (t *Transpiler) canHoist(expr ast.Expr) bool {
+	if t.hoist == nil {
+		return false
+	}
+
+	calls := countCalls(expr)
+	safe := true
+
+	// visit walks the nodes evaluated before expr, in evaluation order. It
+	// returns true when expr is reached. The operations that contain expr
+	// are evaluated after it.
+	var visit func(node ast.Node) bool
+	visit = func(node ast.Node) bool {
+		if node == expr {
+			return true
+		}
+		if !containsNode(node, expr) {
+			if t.hoist.evaluated[node] {
+				return false
+			}
+			// the hooks can convert any node into code with side effects
+			if len(t.options.Hooks) > 0 {
+				safe = false
+				return false
+			}
+			inspect(node, func(n ast.Node) bool {
+				switch n.(type) {
+				case *ast.FuncLit:
+					return false
+				case *ast.CallExpr:
+					safe = false
+				case *ast.Ident:
+					safe = safe && calls == 0
+				}
+				return safe
+			})
+			return false
+		}
+		for _, child := range children(node) {
+			if visit(child) || !safe {
+				return true
+			}
+		}
+		return true
+	}
+	visit(t.hoist.root)
+
+	return safe
+}
+
+// containsNode returns true if the node is or contains the expression.
+func containsNode(node ast.Node, expr ast.Expr) bool {
+	found := false
+	inspect(node, func(n ast.Node) bool {
+		found = found || n == expr
+		return !found
+	})
+	return found
+}
+
+// convertOperands converts the operands of an expression, which are evaluated
+// in order. If statements are hoisted out of an operand, the operands before
+// it are evaluated into temporary variables first, so that they still run
+// before the hoisted statements:
+//
+//	local __t1__ = (operand1)
+//	local __t2__
+//	if (cond) then
+//	  ...
+//	end
+//	... __t1__ + __t2__ ...
+//
+// Constants, and variables that the hoisted statements cannot change, are not
+// moved into temporary variables.
+func (t *Transpiler) convertOperands(operands ...ast.Expr) ([]luaExpr, error) {
+	out := make([]luaExpr, len(operands))
+	for idx, operand := range operands {
+		value, err := t.convertExpr(operand)
+		if err != nil {
+			return nil, err
+		}
+		out[idx] = value
+
+		if t.hoist == nil {
+			continue
+		}
+		hoisting, calls := false, 0
+		for _, next := range operands[idx+1:] {
+			hoisting = hoisting || needsHoisting(next)
+			calls += countCalls(next)
+		}
+		if !hoisting {
+			continue
+		}
+
+		t.hoist.evaluated[operand] = true
+		if _, ok := value.(*luaName); isPure(value) || (ok && calls == 0 && len(t.options.Hooks) == 0) {
+			continue
+		}
+		tmp := t.newTemp()
+		t.hoist.pre = append(t.hoist.pre, &luaLocal{names: []string{tmp}, values: []luaExpr{value}})
+		out[idx] = &luaName{name: tmp}
+	}
+	return out, nil
+}
+
+// newTemp returns a name for a new temporary variable. Tengo does not allow
+// variable names like '__t1__', so they cannot clash with user variables.
+func (t *Transpiler) newTemp() string {
+	t.tempCount++
+	return fmt.Sprintf("__t%d__", t.tempCount)
+}
+
+// convertCondExpr converts a conditional expression. If the true value can
+// never be falsy in Lua, it is converted into
+//
+//	(cond) and (true-expr) or (false-expr)
+//
+// Otherwise it is hoisted into a temporary variable:
+//
+//	local __t1__
+//	if (cond) then
+//	  __t1__ = (true-expr)
+//	else
+//	  __t1__ = (false-expr)
+//	end
+//
+// and, where hoisting is not possible (e.g. in the code of a hook), into an
+// immediately called function.
+func (t *Transpiler) convertCondExpr(node *ast.CondExpr) (luaExpr, error) {
+	cond, err := t.convertExpr(node.Cond)
+	if err != nil {
+		return nil, err
+	}
+
+	if isNonFalsy(node.True) || !t.canHoist(node) {
+		trueExpr, err := t.convertConditional(node.True)
+		if err != nil {
+			return nil, err
+		}
+
+		falseExpr, err := t.convertConditional(node.False)
+		if err != nil {
+			return nil, err
+		}
+
+		if isNonFalsy(node.True) {
+			return &luaBinary{
+				op:    "or",
+				left:  &luaBinary{op: "and", left: cond, right: trueExpr},
+				right: falseExpr,
+			}, nil
+		}
+
+		return &luaCall{fn: &luaFunction{body: luaBlock{&luaIf{
+			cond: cond,
+			body: luaBlock{&luaReturn{values: []luaExpr{&luaParen{expr: trueExpr}}}},
+			els:  luaBlock{&luaReturn{values: []luaExpr{&luaParen{expr: falseExpr}}}},
+		}}}}, nil
+	}
+
+	tmp := &luaName{name: t.newTemp()}
+	ifStmt := &luaIf{cond: cond}
+
+	// each branch can hoist its own expressions
+	for idx, expr := range []ast.Expr{node.True, node.False} {
+		pre, value, err := t.convertHoisted(expr)
+		if err != nil {
+			return nil, err
+		}
+
+		branch := append(pre, &luaAssign{targets: []luaExpr{tmp}, values: []luaExpr{value}})
+		if idx == 0 {
+			ifStmt.body = branch
+		} else {
+			ifStmt.els = branch
+		}
+	}
+
+	t.hoist.pre = append(t.hoist.pre, &luaLocal{names: []string{tmp.name}}, ifStmt)
+
+	return tmp, nil
+}
+
+// hoistLogicalExpr hoists '&&' or '||' operation whose right-hand side has
+// expressions to hoist:
+//
+//	local __t1__ = (left-expr)
+//	if __t1__ then         -- 'if not __t1__ then' for '||'
+//	  __t1__ = (right-expr)
+//	end
+func (t *Transpiler) hoistLogicalExpr(node *ast.BinaryExpr) (luaExpr, error) {
+	left, err := t.convertExpr(node.LHS)
+	if err != nil {
+		return nil, err
+	}
+
+	tmp := &luaName{name: t.newTemp()}
+
+	pre, right, err := t.convertHoisted(node.RHS)
+	if err != nil {
+		return nil, err
+	}
+
+	var cond luaExpr = tmp
+	if node.Token == token.LOr {
+		cond = &luaUnary{op: "not", expr: tmp}
+	}
+
+	t.hoist.pre = append(t.hoist.pre,
+		&luaLocal{names: []string{tmp.name}, values: []luaExpr{left}},
+		&luaIf{cond: cond, body: append(pre, &luaAssign{targets: []luaExpr{tmp}, values: []luaExpr{right}})})
+
+	return tmp, nil
+}
+
+// isNonFalsy returns true if the value of the expression is never 'nil' or
+// 'false' in Lua.
+func isNonFalsy(expr ast.Expr) bool {
+	switch expr := expr.(type) {
+	case *ast.IntLit, *ast.FloatLit, *ast.StringLit, *ast.CharLit,
+		*ast.ArrayLit, *ast.MapLit, *ast.FuncLit, *ast.SliceExpr:
+		return true
+	case *ast.BoolLit:
+		return expr.Value
+	case *ast.ParenExpr:
+		return isNonFalsy(expr.Expr)
+	case *ast.UnaryExpr:
+		// '-x' and '^x' are numbers
+		return expr.Token == token.Sub || expr.Token == token.Xor
+	case *ast.BinaryExpr:
+		// arithmetic and bitwise operators produce numbers (or strings)
+		switch expr.Token {
+		case token.Add, token.Sub, token.Mul, token.Quo, token.Rem,
+			token.And, token.Or, token.Xor, token.AndNot, token.Shl, token.Shr:
+			return true
+		}
+	case *ast.CondExpr:
+		return isNonFalsy(expr.True) && isNonFalsy(expr.False)
+	}
+
+	return false
+}
+
+// needsHoisting returns true if the expression has a conditional expression
+// that cannot be converted into 'and'/'or' operators.
+func needsHoisting(expr ast.Expr) bool {
+	found := false
+	inspect(expr, func(n ast.Node) bool {
+		switch n := n.(type) {
+		case *ast.FuncLit:
+			return false
+		case *ast.CondExpr:
+			if !isNonFalsy(n.True) {
+				found = true
+			}
+		}
+		return !found
+	})
+	return found
+}
+
+// countCalls returns the number of function calls in the expression, not
+// counting the calls inside function literals.
+func countCalls(expr ast.Expr) int {
+	calls := 0
+	inspect(expr, func(n ast.Node) bool {
+		switch n.(type) {
+		case *ast.FuncLit:
+			return false
+		case *ast.CallExpr:
+			calls++
+		}
+		return true
+	})
+	return calls
+}
+
+// convertTarget converts the target of a compound assignment or an
+// increment/decrement statement. The target is both read and written, so the
+// container and the key of an index expression are hoisted into temporary
+// variables if evaluating them twice could have side effects:
+//
+//	local __t1__ = (container)
+//	local __t2__ = (key)
+//	__t1__[__t2__]=__t1__[__t2__] + 1
+func (t *Transpiler) convertTarget(expr ast.Expr) (luaBlock, luaExpr, error) {
+	var container, key ast.Expr
+	switch expr := expr.(type) {
+	case *ast.IndexExpr:
+		container, key = expr.Expr, expr.Index
+	case *ast.SelectorExpr:
+		container, key = expr.Expr, expr.Sel
+	}
+
+	if container == nil || (countCalls(expr) == 0 && !needsHoisting(expr)) {
+		out, err := t.convertExpr(expr)
+		return nil, out, err
+	}
+
+	pre, containerOut, err := t.convertHoisted(container)
+	if err != nil {
+		return nil, nil, err
+	}
+	tmp := t.newTemp()
+	pre = append(pre, &luaLocal{names: []string{tmp}, values: []luaExpr{containerOut}})
+
+	keyPre, keyOut, err := t.convertHoisted(key)
+	if err != nil {
+		return nil, nil, err
+	}
+	if countCalls(key) > 0 || needsHoisting(key) {
+		keyTmp := t.newTemp()
+		pre = append(pre, keyPre...)
+		pre = append(pre, &luaLocal{names: []string{keyTmp}, values: []luaExpr{keyOut}})
+		keyOut = &luaName{name: keyTmp}
+	}
+
+	return pre, &luaIndex{obj: &luaName{name: tmp}, key: keyOut}, nil
+}
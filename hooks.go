@@ -0,0 +1,205 @@
+package tengo2lua
+
+import (
+	"github.com/d5/tengo/compiler/ast"
+)
+
+// Hook converts Tengo statements or expressions in place of the default
+// conversion. The hooks of the options are called in order for each
+// statement and for each expression converted as a value; the first one that
+// returns a non-nil LuaCode decides the conversion of the node. A hook
+// returns nil to leave the node to the next hooks and, ultimately, to the
+// default conversion.
+//
+// A hook must return an expression (see HookContext.Expr) for an expression
+// and statements (see HookContext.Stmt and HookContext.Stmts) for a
+// statement.
+type Hook func(ctx *HookContext, node ast.Node) (*LuaCode, error)
+
+// LuaCode is the result of the conversion of a node: a Lua expression or Lua
+// statements.
+type LuaCode struct {
+	expr  luaExpr
+	stmts luaBlock
+}
+
+// IsExpr returns true if the code is an expression.
+func (c *LuaCode) IsExpr() bool {
+	return c.expr != nil
+}
+
+// HookContext is the conversion context of a node passed to a hook.
+type HookContext struct {
+	t    *Transpiler
+	node ast.Node
+	next int
+}
+
+// Default returns the conversion of the node by the next hooks or, if none
+// of them converts it, by the default conversion. A hook that decorates the
+// output of a node calls Default instead of converting the node itself.
+func (ctx *HookContext) Default() (*LuaCode, error) {
+	return ctx.t.applyHooks(ctx.node, ctx.next)
+}
+
+// Convert converts a child node of the node: a statement or an expression.
+// The child is converted by all the hooks. The nodes that define variables
+// (e.g. blocks and function literals) should be converted in the order the
+// default conversion would convert them, so that the script variables are
+// resolved in the right scopes.
+func (ctx *HookContext) Convert(node ast.Node) (*LuaCode, error) {
+	switch node := node.(type) {
+	case ast.Expr:
+		expr, err := ctx.t.convertExpr(node)
+		if err != nil {
+			return nil, err
+		}
+		return &LuaCode{expr: expr}, nil
+	case ast.Stmt:
+		stmts, err := ctx.t.convertStmt(node)
+		if err != nil {
+			return nil, err
+		}
+		return &LuaCode{stmts: stmts}, nil
+	}
+
+	return nil, ctx.Errorf(node, "cannot convert %T", node)
+}
+
+// Expr returns a Lua expression. The template is Lua code where "$1", "$2",
+// ... are replaced by the arguments and "$*" by the list of all the
+// arguments, like the templates of the call rules. The arguments must be
+// expressions; they are evaluated once, in order.
+//
+// The template can refer to Lua globals and helper functions (see Helper).
+// The variables of the script must be passed as arguments.
+func (ctx *HookContext) Expr(template string, args ...*LuaCode) (*LuaCode, error) {
+	tmpl, exprs, err := ctx.template(template, args)
+	if err != nil {
+		return nil, err
+	}
+
+	return &LuaCode{expr: tmpl.apply(exprs)}, nil
+}
+
+// Stmt returns Lua statements written by a template (see Expr). The
+// arguments are substituted as they are. The lines of the template after the
+// first one are indented to the level of the statement: the nested lines
+// should start with Indent.
+func (ctx *HookContext) Stmt(template string, args ...*LuaCode) (*LuaCode, error) {
+	tmpl, exprs, err := ctx.template(template, args)
+	if err != nil {
+		return nil, err
+	}
+
+	return &LuaCode{stmts: luaBlock{&luaTemplateStmt{tmpl: tmpl.expand(exprs)}}}, nil
+}
+
+// Stmts returns the concatenation of Lua statements. Nil codes are ignored,
+// so Stmts() returns no statements.
+func (ctx *HookContext) Stmts(codes ...*LuaCode) (*LuaCode, error) {
+	out := &LuaCode{stmts: luaBlock{}}
+	for _, code := range codes {
+		if code == nil {
+			continue
+		}
+		if code.IsExpr() {
+			return nil, ctx.Errorf(ctx.node, "expression used as statements")
+		}
+		out.stmts = append(out.stmts, code.stmts...)
+	}
+
+	return out, nil
+}
+
+// Helper returns the Lua name of a helper function (e.g. "iter") or of a
+// builtin function (e.g. "len") and adds it to the converted code.
+func (ctx *HookContext) Helper(name string) (string, error) {
+	t := ctx.t
+	if t.isBuiltin(name) {
+		t.builtinFuncsUsed[name] = true
+		return t.runtimeName(name), nil
+	}
+	for h, helperName := range helperNames {
+		if helperName == name && helperSupported(h, t.options.Target) {
+			t.helpersUsed[h] = true
+			return t.runtimeName(name), nil
+		}
+	}
+
+	return "", ctx.Errorf(ctx.node, "unknown helper function '%s'", name)
+}
+
+// Indent returns the indentation of a block level in the converted code.
+func (ctx *HookContext) Indent() string {
+	if ctx.t.options.Minify {
+		return ""
+	}
+	return ctx.t.options.Indent
+}
+
+// TypeOf returns the inferred type of a Tengo expression.
+func (ctx *HookContext) TypeOf(expr ast.Expr) Type {
+	return ctx.t.typeOf(expr)
+}
+
+// Errorf returns a conversion error at the position of a node.
+func (ctx *HookContext) Errorf(node ast.Node, format string, args ...interface{}) error {
+	return ctx.t.error(node, format, args...)
+}
+
+// template parses the template of a hook and checks its arguments.
+func (ctx *HookContext) template(code string, args []*LuaCode) (*callTemplate, []luaExpr, error) {
+	t := ctx.t
+	tmpl, err := parseTemplate(code, t.options.Minify)
+	if err != nil {
+		return nil, nil, ctx.Errorf(ctx.node, "%s of hook", err.Error())
+	}
+	if len(args) < tmpl.numArgs || (len(args) > tmpl.numArgs && !tmpl.variadic) {
+		return nil, nil, ctx.Errorf(ctx.node, "wrong number of arguments for hook template '%s': want %d, got %d", code, tmpl.numArgs, len(args))
+	}
+	if global := t.shadowedName(tmpl); global != "" {
+		return nil, nil, ctx.Errorf(ctx.node, "hook template refers to '%s', which is shadowed by a variable", global)
+	}
+
+	var exprs []luaExpr
+	for _, arg := range args {
+		if arg == nil || !arg.IsExpr() {
+			return nil, nil, ctx.Errorf(ctx.node, "statements used as an argument of hook template '%s'", code)
+		}
+		exprs = append(exprs, arg.expr)
+	}
+
+	return tmpl, exprs, nil
+}
+
+// applyHooks converts a node with the hooks of the options, starting with
+// the hook at index idx, or with the default conversion.
+func (t *Transpiler) applyHooks(node ast.Node, idx int) (*LuaCode, error) {
+	for ; idx < len(t.options.Hooks); idx++ {
+		code, err := t.options.Hooks[idx](&HookContext{t: t, node: node, next: idx + 1}, node)
+		if err != nil {
+			return nil, err
+		}
+		if code != nil {
+			return code, nil
+		}
+	}
+
+	switch node := node.(type) {
+	case ast.Expr:
+		expr, err := t.lowerExpr(node)
+		if err != nil {
+			return nil, err
+		}
+		return &LuaCode{expr: expr}, nil
+	case ast.Stmt:
+		stmts, err := t.lowerStmt(node)
+		if err != nil {
+			return nil, err
+		}
+		return &LuaCode{stmts: stmts}, nil
+	}
+
+	return nil, t.error(node, "cannot convert %T", node)
+}
@@ -0,0 +1,47 @@
+package tengo2lua
+
+import (
+	"fmt"
+	"strings"
+)
+
+// HostGlobal is a name the host provides to the converted code, such as a
+// function it registers in the Lua state.
+type HostGlobal struct {
+	// Name is the name used in Tengo code.
+	Name string
+
+	// LuaName is the name of the value on the Lua side. It can be a dotted
+	// path (e.g. "log.info"). It defaults to Name.
+	LuaName string
+}
+
+// hostPath returns the path of a host global: the names of the Lua global
+// and of the fields that hold its value.
+func hostPath(opts *Options, g HostGlobal) ([]string, error) {
+	luaName := g.LuaName
+	if luaName == "" {
+		luaName = g.Name
+	}
+	if opts.HostTable != "" {
+		luaName = opts.HostTable + "." + luaName
+	}
+
+	path := strings.Split(luaName, ".")
+	for _, name := range path {
+		if !isLuaName(name) {
+			return nil, fmt.Errorf("invalid Lua name '%s' of host global '%s'", luaName, g.Name)
+		}
+	}
+
+	return path, nil
+}
+
+// hostGlobalExpr returns the Lua expression of a host global.
+func hostGlobalExpr(path []string) luaExpr {
+	var expr luaExpr = &luaName{name: path[0]}
+	for _, name := range path[1:] {
+		expr = &luaIndex{obj: expr, key: &luaStringLit{value: name}}
+	}
+	return expr
+}
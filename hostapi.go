@@ -0,0 +1,326 @@
+package tengo2lua
+
+import (
+	"fmt"
+	"io/ioutil"
+	"strconv"
+	"strings"
+	"text/scanner"
+
+	"github.com/d5/tengo/compiler/ast"
+	"github.com/d5/tengo/objects"
+)
+
+// HostAPI describes the functions, the variables and the constants the host
+// provides to the converted code. The functions and the variables are host
+// globals (see Options.HostGlobals); the calls to the functions are checked
+// against their declarations. The constants are replaced by their values.
+type HostAPI struct {
+	Funcs  map[string]*HostFunc
+	Vars   map[string]Type
+	Consts map[string]*HostConst
+}
+
+// HostFunc is the declaration of a host function.
+type HostFunc struct {
+	Name   string
+	Params []HostParam
+
+	// Variadic is true if the last parameter accepts any number of
+	// arguments.
+	Variadic bool
+
+	// Result is the type of the value returned by the function.
+	Result Type
+}
+
+// HostParam is a parameter of a host function. The type of a parameter that
+// accepts any value is TypeUnknown.
+type HostParam struct {
+	Name string
+	Type Type
+}
+
+// HostConst is a constant of the host API. Value is an int64, a float64, a
+// string or a bool.
+type HostConst struct {
+	Name  string
+	Type  Type
+	Value interface{}
+}
+
+// LoadHostAPI reads a host API declaration file.
+func LoadHostAPI(filename string) (*HostAPI, error) {
+	src, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	return ParseHostAPI(filename, src)
+}
+
+// ParseHostAPI parses host API declarations:
+//
+//	// comment
+//	func emit(value)
+//	func log(level string, args ...)
+//	func clamp(x float, min float, max float) float
+//	var config map
+//	const version = "1.2.0"
+//	const max_items = 100
+//
+// The types are int, float, string, bool, array, map, function and any. A
+// parameter without a type accepts any value, and a function without a result
+// type returns any value. An int value can be passed to a float parameter.
+func ParseHostAPI(filename string, src []byte) (*HostAPI, error) {
+	p := &hostAPIParser{
+		api: &HostAPI{
+			Funcs:  make(map[string]*HostFunc),
+			Vars:   make(map[string]Type),
+			Consts: make(map[string]*HostConst),
+		},
+	}
+	p.s.Init(strings.NewReader(string(src)))
+	p.s.Filename = filename
+	p.s.Mode = scanner.ScanIdents | scanner.ScanInts | scanner.ScanFloats | scanner.ScanStrings | scanner.ScanComments | scanner.SkipComments
+	p.s.Error = func(s *scanner.Scanner, msg string) {
+		if p.err == nil {
+			p.err = fmt.Errorf("%s: %s", s.Position, msg)
+		}
+	}
+	p.next()
+
+	for p.tok != scanner.EOF && p.err == nil {
+		pos := p.s.Position
+		keyword := p.ident()
+		name := p.ident()
+		if p.err != nil {
+			break
+		}
+		if p.isDeclared(name) {
+			p.errorf(pos, "'%s' redeclared", name)
+			break
+		}
+
+		switch keyword {
+		case "func":
+			p.api.Funcs[name] = p.funcDecl(name)
+		case "var":
+			p.api.Vars[name] = p.optionalType()
+		case "const":
+			p.expect('=')
+			p.api.Consts[name] = p.constValue(name)
+		default:
+			p.errorf(pos, "expected 'func', 'var' or 'const', found '%s'", keyword)
+		}
+	}
+
+	if p.err != nil {
+		return nil, p.err
+	}
+
+	return p.api, nil
+}
+
+// hostAPIParser parses host API declarations. Only the first error is
+// reported.
+type hostAPIParser struct {
+	s        scanner.Scanner
+	tok      rune
+	prevLine int
+	api      *HostAPI
+	err      error
+}
+
+func (p *hostAPIParser) next() {
+	p.prevLine = p.s.Pos().Line
+	p.tok = p.s.Scan()
+}
+
+func (p *hostAPIParser) errorf(pos scanner.Position, format string, args ...interface{}) {
+	if p.err == nil {
+		p.err = fmt.Errorf("%s: %s", pos, fmt.Sprintf(format, args...))
+	}
+}
+
+func (p *hostAPIParser) expect(tok rune) {
+	if p.tok != tok {
+		p.errorf(p.s.Position, "expected '%c', found %s", tok, p.found())
+	}
+	p.next()
+}
+
+func (p *hostAPIParser) ident() string {
+	name := p.s.TokenText()
+	if p.tok != scanner.Ident {
+		p.errorf(p.s.Position, "expected name, found %s", p.found())
+	}
+	p.next()
+	return name
+}
+
+// found describes the current token in error messages.
+func (p *hostAPIParser) found() string {
+	if p.tok == scanner.EOF {
+		return "end of file"
+	}
+	return "'" + p.s.TokenText() + "'"
+}
+
+func (p *hostAPIParser) isDeclared(name string) bool {
+	_, isFunc := p.api.Funcs[name]
+	_, isVar := p.api.Vars[name]
+	_, isConst := p.api.Consts[name]
+	return isFunc || isVar || isConst
+}
+
+// optionalType parses a type if the next token is a name on the same line.
+func (p *hostAPIParser) optionalType() Type {
+	if p.tok != scanner.Ident || p.s.Position.Line != p.prevLine {
+		return TypeUnknown
+	}
+	return p.typeName()
+}
+
+func (p *hostAPIParser) typeName() Type {
+	pos := p.s.Position
+	name := p.ident()
+	if name == "any" {
+		return TypeUnknown
+	}
+	for typ, typeName := range typeNames {
+		if typ != TypeUnknown && typeName == name {
+			return typ
+		}
+	}
+	p.errorf(pos, "unknown type '%s'", name)
+
+	return TypeUnknown
+}
+
+func (p *hostAPIParser) funcDecl(name string) *HostFunc {
+	fn := &HostFunc{Name: name}
+
+	p.expect('(')
+	for p.tok != ')' && p.err == nil {
+		if len(fn.Params) > 0 {
+			p.expect(',')
+		}
+		if fn.Variadic {
+			p.errorf(p.s.Position, "variadic parameter must be the last one")
+		}
+
+		param := HostParam{Name: p.ident()}
+		if p.tok == '.' {
+			for i := 0; i < 3; i++ {
+				p.expect('.')
+			}
+			fn.Variadic = true
+		}
+		if p.tok == scanner.Ident {
+			param.Type = p.typeName()
+		}
+		fn.Params = append(fn.Params, param)
+	}
+	p.expect(')')
+	fn.Result = p.optionalType()
+
+	return fn
+}
+
+func (p *hostAPIParser) constValue(name string) *HostConst {
+	pos := p.s.Position
+
+	sign := ""
+	if p.tok == '-' {
+		sign = "-"
+		p.next()
+	}
+
+	text := p.s.TokenText()
+	c := &HostConst{Name: name}
+	var err error
+	switch {
+	case p.tok == scanner.Int:
+		c.Type = TypeInt
+		c.Value, err = strconv.ParseInt(sign+text, 0, 64)
+	case p.tok == scanner.Float:
+		c.Type = TypeFloat
+		c.Value, err = strconv.ParseFloat(sign+text, 64)
+	case p.tok == scanner.String && sign == "":
+		c.Type = TypeString
+		c.Value, err = strconv.Unquote(text)
+	case p.tok == scanner.Ident && sign == "" && (text == "true" || text == "false"):
+		c.Type = TypeBool
+		c.Value = text == "true"
+	default:
+		p.errorf(pos, "invalid constant value '%s%s'", sign, text)
+	}
+	if err != nil {
+		p.errorf(pos, "invalid constant value '%s%s'", sign, text)
+	}
+	p.next()
+
+	return c
+}
+
+// object returns the Tengo value of the constant.
+func (c *HostConst) object() objects.Object {
+	switch value := c.Value.(type) {
+	case int64:
+		return &objects.Int{Value: value}
+	case float64:
+		return &objects.Float{Value: value}
+	case string:
+		return &objects.String{Value: value}
+	case bool:
+		if value {
+			return objects.TrueValue
+		}
+		return objects.FalseValue
+	}
+	return objects.UndefinedValue
+}
+
+// acceptsType returns true if a value of type arg can be passed to a
+// parameter of type param. Unknown types are always accepted.
+func acceptsType(param, arg Type) bool {
+	return param == TypeUnknown || arg == TypeUnknown || param == arg || (param == TypeFloat && arg == TypeInt)
+}
+
+// checkHostCall checks the arguments of a call to a host function against its
+// declaration.
+func (t *Transpiler) checkHostCall(node *ast.CallExpr) error {
+	ident, ok := node.Func.(*ast.Ident)
+	if !ok || t.options.HostAPI == nil {
+		return nil
+	}
+	fn, ok := t.options.HostAPI.Funcs[ident.Name]
+	if !ok {
+		return nil
+	}
+	if _, _, defined := t.symbolTable.Resolve(ident.Name); defined {
+		return nil
+	}
+
+	numParams := len(fn.Params)
+	if fn.Variadic {
+		if len(node.Args) < numParams-1 {
+			return t.error(node, "not enough arguments in call to '%s': want at least %d, got %d", fn.Name, numParams-1, len(node.Args))
+		}
+	} else if len(node.Args) != numParams {
+		return t.error(node, "wrong number of arguments in call to '%s': want %d, got %d", fn.Name, numParams, len(node.Args))
+	}
+
+	for idx, arg := range node.Args {
+		param := fn.Params[len(fn.Params)-1]
+		if idx < len(fn.Params) {
+			param = fn.Params[idx]
+		}
+		if argType := t.typeOf(arg); !acceptsType(param.Type, argType) {
+			return t.error(arg, "cannot use %s as %s value of parameter '%s' in call to '%s'", argType, param.Type, param.Name, fn.Name)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,532 @@
+package tengo2lua
+
+import (
+	"github.com/d5/tengo/compiler"
+	"github.com/d5/tengo/compiler/ast"
+	"github.com/d5/tengo/compiler/source"
+	"github.com/d5/tengo/compiler/token"
+)
+
+// Type is the static type of a Tengo expression.
+type Type int
+
+// Types of Tengo expressions.
+const (
+	TypeUnknown Type = iota
+	TypeInt
+	TypeFloat
+	TypeString
+	TypeBool
+	TypeArray
+	TypeMap
+	TypeFunction
+)
+
+var typeNames = map[Type]string{
+	TypeUnknown:  "unknown",
+	TypeInt:      "int",
+	TypeFloat:    "float",
+	TypeString:   "string",
+	TypeBool:     "bool",
+	TypeArray:    "array",
+	TypeMap:      "map",
+	TypeFunction: "function",
+}
+
+func (t Type) String() string {
+	return typeNames[t]
+}
+
+func (t Type) isNumber() bool {
+	return t == TypeInt || t == TypeFloat
+}
+
+// TypeInfo holds the types inferred for the expressions of a Tengo script.
+type TypeInfo struct {
+	// File is the AST of the script. Constant expressions are folded if
+	// Options.FoldConstants is set.
+	File *ast.File
+
+	// Types maps the expressions of File to their types.
+	Types map[ast.Expr]Type
+
+	file *source.File
+}
+
+// TypeOf returns the type of an expression.
+func (info *TypeInfo) TypeOf(expr ast.Expr) Type {
+	return info.Types[expr]
+}
+
+// Position returns the position of a node of File in the source code.
+func (info *TypeInfo) Position(pos source.Pos) source.FilePos {
+	return info.file.Position(pos)
+}
+
+// InferTypes parses the Tengo code and infers the types of its expressions
+// without converting it.
+func (t *Transpiler) InferTypes() (*TypeInfo, error) {
+	if err := t.init(); err != nil {
+		return nil, err
+	}
+
+	astFile, err := t.parse()
+	if err != nil {
+		return nil, err
+	}
+
+	if t.options.FoldConstants {
+		t.foldConstants(astFile)
+	}
+
+	return &TypeInfo{
+		File:  astFile,
+		Types: inferTypes(astFile, t.prelude, t.options.HostAPI),
+		file:  t.file,
+	}, nil
+}
+
+// typeInferrer is a flow-sensitive type inference pass. It follows the
+// scoping rules of the compiler with its own symbol table, and tracks the
+// type of each variable along the statements.
+//
+// The analysis is conservative:
+//   - the types of the variables at the end of "if" branches are joined, and
+//     loops are analyzed until the types at the start of the body are stable.
+//   - variables reassigned in any function, and global variables read in a
+//     function, can be changed by function calls, so their type is unknown.
+type typeInferrer struct {
+	types        map[ast.Expr]Type
+	symbolTable  *compiler.SymbolTable
+	env          map[*compiler.Symbol]Type
+	funcDepth    int
+	funcAssigned map[string]bool
+	prelude      map[string]*preludeFunc
+	host         *HostAPI
+}
+
+// inferTypes returns the types of the expressions of a Tengo script.
+func inferTypes(file *ast.File, prelude map[string]*preludeFunc, host *HostAPI) map[ast.Expr]Type {
+	ti := &typeInferrer{
+		prelude:      prelude,
+		host:         host,
+		types:        make(map[ast.Expr]Type),
+		symbolTable:  compiler.NewSymbolTable(),
+		env:          make(map[*compiler.Symbol]Type),
+		funcAssigned: reassignedInFuncs(file),
+	}
+	ti.stmts(file.Stmts)
+	return ti.types
+}
+
+// reassignedInFuncs returns the names of the variables assigned in function
+// bodies. Unlike assignedInFuncs, variable definitions are not included.
+func reassignedInFuncs(file *ast.File) map[string]bool {
+	names := make(map[string]bool)
+	inspect(file, func(n ast.Node) bool {
+		fn, ok := n.(*ast.FuncLit)
+		if !ok {
+			return true
+		}
+		inspect(fn.Body, func(n ast.Node) bool {
+			switch n := n.(type) {
+			case *ast.AssignStmt:
+				if n.Token != token.Define {
+					for _, lhs := range n.LHS {
+						name, _ := resolveAssignLHS(lhs)
+						names[name] = true
+					}
+				}
+			case *ast.IncDecStmt:
+				name, _ := resolveAssignLHS(n.Expr)
+				names[name] = true
+			}
+			return true
+		})
+		return false
+	})
+	return names
+}
+
+func (ti *typeInferrer) stmts(stmts []ast.Stmt) {
+	for _, stmt := range stmts {
+		ti.stmt(stmt)
+	}
+}
+
+func (ti *typeInferrer) stmt(stmt ast.Stmt) {
+	switch node := stmt.(type) {
+	case *ast.BlockStmt:
+		ti.stmts(node.Stmts)
+
+	case *ast.ExprStmt:
+		ti.expr(node.Expr)
+
+	case *ast.IncDecStmt:
+		typ := ti.expr(node.Expr)
+		if ident, ok := node.Expr.(*ast.Ident); ok {
+			if !typ.isNumber() {
+				typ = TypeUnknown
+			}
+			ti.assign(ident.Name, typ)
+		}
+
+	case *ast.AssignStmt:
+		ti.assignStmt(node)
+
+	case *ast.ReturnStmt:
+		if node.Result != nil {
+			ti.expr(node.Result)
+		}
+
+	case *ast.ExportStmt:
+		ti.expr(node.Result)
+
+	case *ast.IfStmt:
+		ti.symbolTable = ti.symbolTable.Fork(true)
+		defer func() { ti.symbolTable = ti.symbolTable.Parent(false) }()
+
+		if node.Init != nil {
+			ti.stmt(node.Init)
+		}
+		ti.expr(node.Cond)
+
+		before := ti.copyEnv()
+		ti.stmt(node.Body)
+
+		// "if true { ... }" is left by constant folding
+		if lit, ok := node.Cond.(*ast.BoolLit); ok && lit.Value && node.Else == nil {
+			return
+		}
+
+		afterBody := ti.env
+		ti.env = copyEnv(before)
+		if node.Else != nil {
+			ti.stmt(node.Else)
+		}
+		ti.env = joinEnv(before, afterBody, ti.env)
+
+	case *ast.ForStmt:
+		ti.symbolTable = ti.symbolTable.Fork(true)
+		defer func() { ti.symbolTable = ti.symbolTable.Parent(false) }()
+
+		if node.Init != nil {
+			ti.stmt(node.Init)
+		}
+		ti.loop(func() {
+			if node.Cond != nil {
+				ti.expr(node.Cond)
+			}
+			ti.stmt(node.Body)
+			if node.Post != nil {
+				ti.stmt(node.Post)
+			}
+		})
+
+	case *ast.ForInStmt:
+		ti.symbolTable = ti.symbolTable.Fork(true)
+		defer func() { ti.symbolTable = ti.symbolTable.Parent(false) }()
+
+		keyType := TypeUnknown
+		switch ti.expr(node.Iterable) {
+		case TypeArray:
+			keyType = TypeInt
+		case TypeMap:
+			keyType = TypeString
+		}
+
+		ti.loop(func() {
+			if node.Key.Name != "_" {
+				ti.env[ti.symbolTable.Define(node.Key.Name)] = keyType
+			}
+			if node.Value.Name != "_" {
+				ti.symbolTable.Define(node.Value.Name)
+			}
+			ti.stmt(node.Body)
+		})
+	}
+}
+
+// loop analyzes the body of a loop until the types of the variables at the
+// start of the body are stable.
+func (ti *typeInferrer) loop(body func()) {
+	for {
+		entry := ti.copyEnv()
+		body()
+		ti.env = joinEnv(entry, entry, ti.env)
+		if equalEnv(entry, ti.env) {
+			return
+		}
+	}
+}
+
+func (ti *typeInferrer) assignStmt(node *ast.AssignStmt) {
+	if len(node.LHS) != 1 || len(node.RHS) != 1 {
+		for _, expr := range append(node.LHS, node.RHS...) {
+			ti.expr(expr)
+		}
+		return
+	}
+
+	lhs, rhs := node.LHS[0], node.RHS[0]
+	ident, isIdent := lhs.(*ast.Ident)
+
+	switch node.Token {
+	case token.Define:
+		if !isIdent {
+			ti.expr(rhs)
+			return
+		}
+
+		// the variable is defined before the right-hand side is evaluated
+		symbol := ti.symbolTable.Define(ident.Name)
+		typ := ti.expr(rhs)
+		ti.env[symbol] = typ
+		ti.types[lhs] = typ
+
+	case token.Assign:
+		if !isIdent {
+			ti.expr(lhs)
+			ti.expr(rhs)
+			return
+		}
+
+		typ := ti.expr(rhs)
+		ti.assign(ident.Name, typ)
+		ti.types[lhs] = typ
+
+	default:
+		left := ti.expr(lhs)
+		right := ti.expr(rhs)
+		if isIdent {
+			ti.assign(ident.Name, binaryType(compoundAssignOps[node.Token], left, right))
+		}
+	}
+}
+
+// assign sets the type of a variable.
+func (ti *typeInferrer) assign(name string, typ Type) {
+	if symbol, _, ok := ti.symbolTable.Resolve(name); ok {
+		ti.env[symbol] = typ
+	}
+}
+
+// expr infers the type of an expression and its subexpressions.
+func (ti *typeInferrer) expr(expr ast.Expr) Type {
+	typ := ti.exprType(expr)
+	ti.types[expr] = typ
+	return typ
+}
+
+func (ti *typeInferrer) exprType(expr ast.Expr) Type {
+	switch node := expr.(type) {
+	case *ast.IntLit:
+		return TypeInt
+	case *ast.FloatLit:
+		return TypeFloat
+	case *ast.StringLit:
+		return TypeString
+	case *ast.BoolLit:
+		return TypeBool
+
+	case *ast.ArrayLit:
+		for _, elem := range node.Elements {
+			ti.expr(elem)
+		}
+		return TypeArray
+
+	case *ast.MapLit:
+		for _, elem := range node.Elements {
+			ti.expr(elem.Value)
+		}
+		return TypeMap
+
+	case *ast.FuncLit:
+		ti.symbolTable = ti.symbolTable.Fork(false)
+		ti.funcDepth++
+		env := ti.copyEnv()
+		for _, param := range node.Type.Params.List {
+			ti.symbolTable.Define(param.Name)
+		}
+		ti.stmt(node.Body)
+		ti.env = env
+		ti.funcDepth--
+		ti.symbolTable = ti.symbolTable.Parent(true)
+		return TypeFunction
+
+	case *ast.Ident:
+		symbol, _, ok := ti.symbolTable.Resolve(node.Name)
+		if !ok {
+			if fn, ok := ti.prelude[node.Name]; ok && fn.builtin {
+				return TypeFunction
+			}
+			return ti.hostType(node.Name)
+		}
+		if ti.funcAssigned[node.Name] || (ti.funcDepth > 0 && symbol.Scope == compiler.ScopeGlobal) {
+			return TypeUnknown
+		}
+		return ti.env[symbol]
+
+	case *ast.ParenExpr:
+		return ti.expr(node.Expr)
+
+	case *ast.UnaryExpr:
+		operand := ti.expr(node.Expr)
+		switch node.Token {
+		case token.Not:
+			return TypeBool
+		case token.Sub, token.Add:
+			if operand.isNumber() {
+				return operand
+			}
+		case token.Xor:
+			if operand == TypeInt {
+				return TypeInt
+			}
+		}
+		return TypeUnknown
+
+	case *ast.BinaryExpr:
+		return binaryType(node.Token, ti.expr(node.LHS), ti.expr(node.RHS))
+
+	case *ast.CondExpr:
+		ti.expr(node.Cond)
+		return joinType(ti.expr(node.True), ti.expr(node.False))
+
+	case *ast.CallExpr:
+		ti.expr(node.Func)
+		for _, arg := range node.Args {
+			ti.expr(arg)
+		}
+		if ident, ok := node.Func.(*ast.Ident); ok {
+			if _, _, defined := ti.symbolTable.Resolve(ident.Name); !defined {
+				if fn, ok := ti.prelude[ident.Name]; ok && fn.builtin {
+					if ident.Name == "len" && !fn.custom {
+						return TypeInt
+					}
+				} else if ti.host != nil && ti.host.Funcs[ident.Name] != nil {
+					return ti.host.Funcs[ident.Name].Result
+				}
+			}
+		}
+		return TypeUnknown
+
+	case *ast.SliceExpr:
+		typ := ti.expr(node.Expr)
+		if node.Low != nil {
+			ti.expr(node.Low)
+		}
+		if node.High != nil {
+			ti.expr(node.High)
+		}
+		if typ == TypeArray || typ == TypeString {
+			return typ
+		}
+		return TypeUnknown
+
+	case *ast.IndexExpr:
+		ti.expr(node.Expr)
+		ti.expr(node.Index)
+
+	case *ast.SelectorExpr:
+		ti.expr(node.Expr)
+
+	case *ast.ErrorExpr:
+		ti.expr(node.Expr)
+
+	case *ast.ImmutableExpr:
+		ti.expr(node.Expr)
+	}
+
+	return TypeUnknown
+}
+
+// binaryType returns the type of a binary operation in Tengo.
+func binaryType(op token.Token, left, right Type) Type {
+	switch op {
+	case token.LAnd, token.LOr:
+		return joinType(left, right)
+
+	case token.Equal, token.NotEqual, token.Less, token.Greater, token.LessEq, token.GreaterEq:
+		return TypeBool
+
+	case token.Add:
+		switch {
+		case left == TypeString:
+			return TypeString
+		case left == TypeArray && right == TypeArray:
+			return TypeArray
+		}
+		fallthrough
+
+	case token.Sub, token.Mul, token.Quo:
+		switch {
+		case left == TypeInt && right == TypeInt:
+			return TypeInt
+		case left.isNumber() && right.isNumber():
+			return TypeFloat
+		}
+
+	case token.Rem, token.And, token.Or, token.Xor, token.AndNot, token.Shl, token.Shr:
+		if left == TypeInt && right == TypeInt {
+			return TypeInt
+		}
+	}
+
+	return TypeUnknown
+}
+
+func joinType(a, b Type) Type {
+	if a == b {
+		return a
+	}
+	return TypeUnknown
+}
+
+func (ti *typeInferrer) copyEnv() map[*compiler.Symbol]Type {
+	return copyEnv(ti.env)
+}
+
+func copyEnv(env map[*compiler.Symbol]Type) map[*compiler.Symbol]Type {
+	out := make(map[*compiler.Symbol]Type, len(env))
+	for symbol, typ := range env {
+		out[symbol] = typ
+	}
+	return out
+}
+
+// joinEnv joins the types of the variables of 'base' in two environments.
+// Variables defined after 'base' are out of scope.
+func joinEnv(base, a, b map[*compiler.Symbol]Type) map[*compiler.Symbol]Type {
+	out := make(map[*compiler.Symbol]Type, len(base))
+	for symbol := range base {
+		out[symbol] = joinType(a[symbol], b[symbol])
+	}
+	return out
+}
+
+func equalEnv(a, b map[*compiler.Symbol]Type) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for symbol, typ := range a {
+		if b[symbol] != typ {
+			return false
+		}
+	}
+	return true
+}
+
+// hostType returns the type of a name of the host API.
+func (ti *typeInferrer) hostType(name string) Type {
+	if ti.host == nil {
+		return TypeUnknown
+	}
+	if _, ok := ti.host.Funcs[name]; ok {
+		return TypeFunction
+	}
+	if c, ok := ti.host.Consts[name]; ok {
+		return c.Type
+	}
+	return ti.host.Vars[name]
+}
@@ -0,0 +1,69 @@
+package tengo2lua
+
+import (
+	"sort"
+
+	"github.com/d5/tengo/compiler/source"
+)
+
+// Input is a variable the script uses without defining it, like the
+// variables Tengo hosts add with Script.Add. When Options.InputTable is set,
+// the inputs are read from and written to the fields of the input table.
+type Input struct {
+	Name string
+
+	// Reads and Writes are the positions where the script reads and
+	// assigns the variable. A compound assignment (e.g. "x += 1") is both.
+	Reads  []source.FilePos
+	Writes []source.FilePos
+}
+
+// Inputs returns the inputs of the script found by Convert, sorted by name.
+// It returns nil if Options.InputTable is not set.
+func (t *Transpiler) Inputs() []*Input {
+	var inputs []*Input
+	for _, input := range t.inputs {
+		inputs = append(inputs, input)
+	}
+	sort.Slice(inputs, func(i, j int) bool {
+		return inputs[i].Name < inputs[j].Name
+	})
+
+	return inputs
+}
+
+// isInput returns true if an unresolved name is an input of the script.
+func (t *Transpiler) isInput(name string) bool {
+	if t.options.InputTable == "" || t.isBuiltin(name) {
+		return false
+	}
+	if _, ok := t.hostGlobals[name]; ok {
+		return false
+	}
+	if api := t.options.HostAPI; api != nil && api.Consts[name] != nil {
+		return false
+	}
+	return true
+}
+
+// useInput records a use of an input and returns its Lua expression.
+func (t *Transpiler) useInput(name string, pos source.Pos, write bool) (luaExpr, error) {
+	table := t.options.InputTable
+	if _, _, shadowed := t.symbolTable.Resolve(table); shadowed && !needsMangling(table) {
+		return nil, t.errorAt(pos, "input table '%s' is shadowed by a variable", table)
+	}
+
+	input, ok := t.inputs[name]
+	if !ok {
+		input = &Input{Name: name}
+		t.inputs[name] = input
+	}
+	filePos := t.file.Set().Position(pos)
+	if write {
+		input.Writes = append(input.Writes, filePos)
+	} else {
+		input.Reads = append(input.Reads, filePos)
+	}
+
+	return &luaIndex{obj: &luaName{name: table}, key: &luaStringLit{value: name}}, nil
+}
@@ -0,0 +1,167 @@
+package tengo2lua
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// luaString encodes a string value into a Lua string literal. The literal
+// produces exactly the same bytes as the value in all supported Lua versions:
+// only the escape sequences of Lua 5.1 are used, and invalid UTF-8 bytes and
+// control characters are written as decimal escapes ("\ddd").
+//
+// Long brackets ("[==[ ... ]==]") are used instead of a quoted string if
+// they produce a shorter literal.
+func luaString(s string) string {
+	quoted := luaQuotedString(s)
+
+	if long, ok := luaLongString(s); ok && len(long) < len(quoted) {
+		return long
+	}
+
+	return quoted
+}
+
+func luaQuotedString(s string) string {
+	// use the quote character that needs fewer escapes
+	quote := byte('"')
+	if strings.Count(s, `"`) > strings.Count(s, `'`) {
+		quote = '\''
+	}
+
+	var sb strings.Builder
+	sb.WriteByte(quote)
+	for idx := 0; idx < len(s); {
+		c := s[idx]
+
+		switch {
+		case c == quote || c == '\\':
+			sb.WriteByte('\\')
+			sb.WriteByte(c)
+		case c == '\a':
+			sb.WriteString(`\a`)
+		case c == '\b':
+			sb.WriteString(`\b`)
+		case c == '\f':
+			sb.WriteString(`\f`)
+		case c == '\n':
+			sb.WriteString(`\n`)
+		case c == '\r':
+			sb.WriteString(`\r`)
+		case c == '\t':
+			sb.WriteString(`\t`)
+		case c == '\v':
+			sb.WriteString(`\v`)
+		case c >= 0x20 && c < 0x7f:
+			sb.WriteByte(c)
+		case c >= utf8.RuneSelf:
+			// valid UTF-8 sequences are written as they are
+			r, size := utf8.DecodeRuneInString(s[idx:])
+			if r != utf8.RuneError || size > 1 {
+				sb.WriteString(s[idx : idx+size])
+				idx += size
+				continue
+			}
+			writeDecimalEscape(&sb, c, s[idx+1:])
+		default:
+			writeDecimalEscape(&sb, c, s[idx+1:])
+		}
+
+		idx++
+	}
+	sb.WriteByte(quote)
+
+	return sb.String()
+}
+
+// writeDecimalEscape writes a byte as "\ddd" escape sequence. The shortest
+// form is used unless the next character is a digit.
+func writeDecimalEscape(sb *strings.Builder, c byte, next string) {
+	sb.WriteByte('\\')
+	if next != "" && next[0] >= '0' && next[0] <= '9' {
+		sb.WriteString(strconv.FormatInt(int64(c)+1000, 10)[1:])
+		return
+	}
+	sb.WriteString(strconv.Itoa(int(c)))
+}
+
+// luaLongString encodes a string value into a Lua long string literal. It
+// returns false if the value cannot be represented byte-exact as a long
+// string: Lua normalizes line breaks in long strings, and control characters
+// or invalid UTF-8 bytes would end up in the output as they are.
+func luaLongString(s string) (string, bool) {
+	if !utf8.ValidString(s) {
+		return "", false
+	}
+	for idx := 0; idx < len(s); idx++ {
+		if c := s[idx]; (c < 0x20 && c != '\n' && c != '\t') || c == 0x7f {
+			return "", false
+		}
+	}
+
+	// find the lowest level of brackets that does not appear in the value
+	for level := 0; ; level++ {
+		open := "[" + strings.Repeat("=", level) + "["
+		close := "]" + strings.Repeat("=", level) + "]"
+		if strings.Index(s+close, close) != len(s) {
+			continue
+		}
+		// Lua 5.1 rejects "[[" in a level 0 long string
+		if level == 0 && strings.Contains(s, "[[") {
+			continue
+		}
+
+		// a line break immediately following the opening bracket is skipped
+		if strings.HasPrefix(s, "\n") {
+			open += "\n"
+		}
+
+		return open + s + close, true
+	}
+}
+
+// maxExactInt is the largest integer that a Lua 5.1 number (IEEE 754 double)
+// represents exactly.
+const maxExactInt = 1 << 53
+
+// luaInt converts a Tengo integer literal into a Lua numeric literal. The
+// literal is parsed with Go syntax (e.g. "0755" is an octal number) and
+// emitted as a decimal number. Lua dialects without the integer subtype can
+// represent integers up to 2^53 only.
+func luaInt(literal string, target LuaVersion) (string, error) {
+	v, err := strconv.ParseInt(literal, 0, 64)
+	if err != nil {
+		if numErr, ok := err.(*strconv.NumError); ok && numErr.Err == strconv.ErrRange {
+			return "", fmt.Errorf("integer literal '%s' out of range", literal)
+		}
+		return "", fmt.Errorf("invalid integer literal '%s'", literal)
+	}
+
+	if v > maxExactInt && !target.hasIntegers() {
+		return "", fmt.Errorf("integer literal '%s' cannot be represented exactly in %s", literal, target)
+	}
+
+	return strconv.FormatInt(v, 10), nil
+}
+
+// luaFloat converts a Tengo floating-point literal into a Lua numeric literal.
+// The shortest decimal representation that round-trips to the same value is
+// used. It always contains a decimal point or an exponent.
+func luaFloat(literal string) (string, error) {
+	v, err := strconv.ParseFloat(literal, 64)
+	if err != nil {
+		if numErr, ok := err.(*strconv.NumError); ok && numErr.Err == strconv.ErrRange {
+			return "", fmt.Errorf("floating-point literal '%s' out of range", literal)
+		}
+		return "", fmt.Errorf("invalid floating-point literal '%s'", literal)
+	}
+
+	out := strconv.FormatFloat(v, 'g', -1, 64)
+	if !strings.ContainsAny(out, ".e") {
+		out += ".0"
+	}
+
+	return out, nil
+}
@@ -0,0 +1,229 @@
+package tengo2lua
+
+import (
+	"github.com/d5/tengo/compiler/source"
+)
+
+// Lua AST is the intermediate representation of the generated code. Tengo AST
+// is lowered into Lua AST, and luaPrinter turns it into Lua source code.
+
+type luaExpr interface {
+	luaExprNode()
+}
+
+type luaStmt interface {
+	// position returns the Tengo position of the statement, or source.NoPos
+	// if it's the same as the position of the enclosing statement.
+	position() source.Pos
+	setPosition(pos source.Pos)
+}
+
+type luaBlock []luaStmt
+
+// luaStmtPos implements the position of Lua statements.
+type luaStmtPos struct {
+	pos source.Pos
+}
+
+func (s *luaStmtPos) position() source.Pos       { return s.pos }
+func (s *luaStmtPos) setPosition(pos source.Pos) { s.pos = pos }
+
+// Expressions
+
+// luaName is a variable name.
+type luaName struct {
+	name string
+}
+
+// luaLiteral is a numeric literal, "nil", "true" or "false".
+type luaLiteral struct {
+	text string
+}
+
+// luaStringLit is a string literal.
+type luaStringLit struct {
+	value string
+}
+
+// luaTable is a table constructor. Fields without a key are positional.
+type luaTable struct {
+	fields []luaField
+}
+
+type luaField struct {
+	key   luaExpr
+	value luaExpr
+}
+
+// luaIndex is an index expression: "obj[key]" or "obj.key".
+type luaIndex struct {
+	obj luaExpr
+	key luaExpr
+}
+
+// luaCall is a function call.
+type luaCall struct {
+	fn   luaExpr
+	args []luaExpr
+}
+
+// luaFunction is a function definition.
+type luaFunction struct {
+	params []string
+	body   luaBlock
+}
+
+// luaBinary is a binary operation. 'op' is a Lua operator.
+type luaBinary struct {
+	op    string
+	left  luaExpr
+	right luaExpr
+}
+
+// luaUnary is a unary operation. 'op' is a Lua operator.
+type luaUnary struct {
+	op   string
+	expr luaExpr
+}
+
+// luaParen is a parenthesized expression. Parentheses needed by operator
+// precedence are added by the printer: luaParen is used only when they change
+// the meaning of the expression (e.g. to truncate the results of a call).
+type luaParen struct {
+	expr luaExpr
+}
+
+// luaTemplate is an expression of a call rule or of a hook: the code of
+// parts[i] is followed by the expressions args[i], separated by commas.
+// 'names' are the global names the code refers to.
+type luaTemplate struct {
+	parts []string
+	args  [][]luaExpr
+	names []string
+}
+
+func (*luaName) luaExprNode()      {}
+func (*luaLiteral) luaExprNode()   {}
+func (*luaStringLit) luaExprNode() {}
+func (*luaTable) luaExprNode()     {}
+func (*luaIndex) luaExprNode()     {}
+func (*luaCall) luaExprNode()      {}
+func (*luaFunction) luaExprNode()  {}
+func (*luaBinary) luaExprNode()    {}
+func (*luaUnary) luaExprNode()     {}
+func (*luaParen) luaExprNode()     {}
+func (*luaTemplate) luaExprNode()  {}
+
+// Statements
+
+// luaLocal declares local variables: "local a, b = x, y".
+type luaLocal struct {
+	luaStmtPos
+	names  []string
+	values []luaExpr
+}
+
+// luaAssign is an assignment: "a, b = x, y".
+type luaAssign struct {
+	luaStmtPos
+	targets []luaExpr
+	values  []luaExpr
+}
+
+// luaCallStmt is a function call statement.
+type luaCallStmt struct {
+	luaStmtPos
+	call *luaCall
+}
+
+type luaDo struct {
+	luaStmtPos
+	body luaBlock
+}
+
+type luaWhile struct {
+	luaStmtPos
+	cond luaExpr
+	body luaBlock
+}
+
+type luaRepeat struct {
+	luaStmtPos
+	body luaBlock
+	cond luaExpr
+}
+
+// luaIf is an "if" statement. 'els' is nil if there is no "else" block.
+type luaIf struct {
+	luaStmtPos
+	cond luaExpr
+	body luaBlock
+	els  luaBlock
+}
+
+// luaNumericFor is a numeric "for" loop. 'step' is nil for the default step.
+type luaNumericFor struct {
+	luaStmtPos
+	name  string
+	start luaExpr
+	limit luaExpr
+	step  luaExpr
+	body  luaBlock
+}
+
+// luaGenericFor is a generic "for" loop: "for k, v in (exprs) do".
+type luaGenericFor struct {
+	luaStmtPos
+	names []string
+	exprs []luaExpr
+	body  luaBlock
+}
+
+type luaReturn struct {
+	luaStmtPos
+	values []luaExpr
+}
+
+type luaBreak struct {
+	luaStmtPos
+}
+
+type luaGoto struct {
+	luaStmtPos
+	label string
+}
+
+type luaLabel struct {
+	luaStmtPos
+	name string
+}
+
+// luaTemplateStmt is a statement of a hook.
+type luaTemplateStmt struct {
+	luaStmtPos
+	tmpl *luaTemplate
+}
+
+// luaRawStmt is Lua code that is printed as it is (e.g. the helper
+// functions).
+type luaRawStmt struct {
+	luaStmtPos
+	code string
+}
+
+// luaNil, luaTrue and luaFalse are shared literals.
+var (
+	luaNil   = &luaLiteral{text: "nil"}
+	luaTrue  = &luaLiteral{text: "true"}
+	luaFalse = &luaLiteral{text: "false"}
+)
+
+// luaNameIndex returns "obj.key".
+func luaNameIndex(obj string, key string) *luaIndex {
+	return &luaIndex{obj: &luaName{name: obj}, key: &luaStringLit{value: key}}
+}
+
+// luaCallName returns "fn(args...)".
+func luaCallName(fn string, args ...luaExpr) *luaCall {
+	return &luaCall{fn: &luaName{name: fn}, args: args}
+}
@@ -0,0 +1,242 @@
+package tengo2lua
+
+// minifier renames the local variables and the function parameters of a Lua
+// chunk into short names.
+//
+// It walks the chunk twice with the same scoping rules: the first walk finds
+// the free (global) names, and the second one renames every local variable
+// to a name that is neither a free name, a Lua keyword nor a standard Lua
+// global. A new name is chosen by the number of locals visible at the point
+// of its declaration, so it never shadows a local that is still in use.
+type minifier struct {
+	rename    bool
+	scopes    []map[string]string
+	visible   int
+	free      map[string]bool
+	names     []string
+	candidate int
+	done      map[*luaName]bool
+}
+
+// minifyChunk renames the locals of the chunk. It returns the names the chunk
+// refers to as globals.
+func minifyChunk(chunk luaBlock) map[string]bool {
+	m := &minifier{
+		free: make(map[string]bool),
+		done: make(map[*luaName]bool),
+	}
+	m.scopedBlock(chunk, nil)
+
+	m.rename = true
+	m.scopedBlock(chunk, nil)
+
+	return m.free
+}
+
+func (m *minifier) openScope() {
+	m.scopes = append(m.scopes, make(map[string]string))
+}
+
+func (m *minifier) closeScope() {
+	scope := m.scopes[len(m.scopes)-1]
+	m.visible -= len(scope)
+	m.scopes = m.scopes[:len(m.scopes)-1]
+}
+
+// declare declares a local variable in the innermost scope and returns its
+// new name.
+func (m *minifier) declare(name string) string {
+	scope := m.scopes[len(m.scopes)-1]
+	if newName, ok := scope[name]; ok {
+		// redeclared in the same scope: the previous variable is no longer
+		// accessible, so its name can be reused.
+		return newName
+	}
+
+	newName := name
+	if m.rename {
+		newName = m.shortName(m.visible)
+	}
+	scope[name] = newName
+	m.visible++
+
+	return newName
+}
+
+func (m *minifier) declareAll(names []string) {
+	for idx, name := range names {
+		names[idx] = m.declare(name)
+	}
+}
+
+// shortName returns the n-th available short name.
+func (m *minifier) shortName(n int) string {
+	for len(m.names) <= n {
+		name := nameSequence(m.candidate)
+		m.candidate++
+		if !m.free[name] && !luaKeywords[name] && !luaGlobals[name] && !runtimeNames[name] {
+			m.names = append(m.names, name)
+		}
+	}
+
+	return m.names[n]
+}
+
+// nameSequence returns the n-th name of the sequence: a, ..., Z, aa, ab, ...
+func nameSequence(n int) string {
+	const chars = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ"
+
+	var name []byte
+	for ; ; n = n/len(chars) - 1 {
+		name = append([]byte{chars[n%len(chars)]}, name...)
+		if n < len(chars) {
+			break
+		}
+	}
+
+	return string(name)
+}
+
+func (m *minifier) resolve(name *luaName) {
+	for idx := len(m.scopes) - 1; idx >= 0; idx-- {
+		if newName, ok := m.scopes[idx][name.name]; ok {
+			if m.rename && !m.done[name] {
+				// nodes can be shared by several expressions
+				name.name = newName
+				m.done[name] = true
+			}
+			return
+		}
+	}
+
+	if !m.rename {
+		m.free[name.name] = true
+	}
+}
+
+func (m *minifier) block(block luaBlock) {
+	for _, stmt := range block {
+		m.stmt(stmt)
+	}
+}
+
+// scopedBlock walks a block with its own scope.
+func (m *minifier) scopedBlock(block luaBlock, names []string) {
+	m.openScope()
+	m.declareAll(names)
+	m.block(block)
+	m.closeScope()
+}
+
+func (m *minifier) stmt(stmt luaStmt) {
+	switch stmt := stmt.(type) {
+	case *luaLocal:
+		// the values cannot refer to the new locals, but their short names
+		// are reserved: a function defined by the statement must not give
+		// them to its parameters
+		m.visible += len(stmt.names)
+		m.exprs(stmt.values)
+		m.visible -= len(stmt.names)
+		m.declareAll(stmt.names)
+
+	case *luaAssign:
+		m.exprs(stmt.targets)
+		m.exprs(stmt.values)
+
+	case *luaCallStmt:
+		m.expr(stmt.call)
+
+	case *luaDo:
+		m.scopedBlock(stmt.body, nil)
+
+	case *luaWhile:
+		m.expr(stmt.cond)
+		m.scopedBlock(stmt.body, nil)
+
+	case *luaRepeat:
+		// the condition can refer to the locals of the body
+		m.openScope()
+		m.block(stmt.body)
+		m.expr(stmt.cond)
+		m.closeScope()
+
+	case *luaIf:
+		m.expr(stmt.cond)
+		m.scopedBlock(stmt.body, nil)
+		if stmt.els != nil {
+			m.scopedBlock(stmt.els, nil)
+		}
+
+	case *luaNumericFor:
+		m.expr(stmt.start)
+		m.expr(stmt.limit)
+		if stmt.step != nil {
+			m.expr(stmt.step)
+		}
+		names := []string{stmt.name}
+		m.scopedBlock(stmt.body, names)
+		stmt.name = names[0]
+
+	case *luaGenericFor:
+		m.exprs(stmt.exprs)
+		m.scopedBlock(stmt.body, stmt.names)
+
+	case *luaReturn:
+		m.exprs(stmt.values)
+
+	case *luaTemplateStmt:
+		m.expr(stmt.tmpl)
+	}
+}
+
+func (m *minifier) exprs(exprs []luaExpr) {
+	for _, expr := range exprs {
+		m.expr(expr)
+	}
+}
+
+func (m *minifier) expr(expr luaExpr) {
+	switch expr := expr.(type) {
+	case *luaName:
+		m.resolve(expr)
+
+	case *luaTable:
+		for _, field := range expr.fields {
+			if field.key != nil {
+				m.expr(field.key)
+			}
+			m.expr(field.value)
+		}
+
+	case *luaIndex:
+		m.expr(expr.obj)
+		m.expr(expr.key)
+
+	case *luaCall:
+		m.expr(expr.fn)
+		m.exprs(expr.args)
+
+	case *luaFunction:
+		m.scopedBlock(expr.body, expr.params)
+
+	case *luaBinary:
+		m.expr(expr.left)
+		m.expr(expr.right)
+
+	case *luaUnary:
+		m.expr(expr.expr)
+
+	case *luaParen:
+		m.expr(expr.expr)
+
+	case *luaTemplate:
+		if !m.rename {
+			for _, name := range expr.names {
+				m.free[name] = true
+			}
+		}
+		for _, args := range expr.args {
+			m.exprs(args)
+		}
+	}
+}
@@ -0,0 +1,99 @@
+package tengo2lua
+
+import (
+	"fmt"
+	"strings"
+)
+
+// luaKeywords is a set of reserved words in all supported Lua versions.
+var luaKeywords = map[string]bool{
+	"and": true, "break": true, "do": true, "else": true, "elseif": true,
+	"end": true, "false": true, "for": true, "function": true, "goto": true,
+	"if": true, "in": true, "local": true, "nil": true, "not": true,
+	"or": true, "repeat": true, "return": true, "then": true, "true": true,
+	"until": true, "while": true,
+}
+
+// luaGlobals is a set of global names provided by the standard libraries of
+// any supported Lua dialect.
+var luaGlobals = func() map[string]bool {
+	names := map[string]bool{}
+	for _, v := range []LuaVersion{Lua51, Lua52, Lua53, Lua54, LuaJIT} {
+		for name := range v.globals() {
+			names[name] = true
+		}
+	}
+	return names
+}()
+
+// runtimeNames is a set of names, other than the standard Lua globals, that
+// the generated code and the runtime helpers depend on.
+var runtimeNames = map[string]bool{
+	"_ENV": true,
+}
+
+// LuaName returns the Lua name of a Tengo variable (global, local or function
+// parameter). Tengo names that are Lua keywords, that contain characters not
+// allowed in Lua 5.1 identifiers, or that collide with names used by the Lua
+// runtime are mangled into "__<encoded name>__". Tengo does not allow such
+// variable names, so mangled names cannot collide with any other variable.
+//
+// The mapping is deterministic and does not depend on the converted code, so
+// the host can use it to access the global variables of a converted script.
+func LuaName(name string) string {
+	if !needsMangling(name) {
+		return name
+	}
+
+	// the encoding is injective: '_' is doubled and any other character that
+	// is not allowed in Lua identifiers is escaped as "_uXXXX" or
+	// "_UXXXXXXXX".
+	var sb strings.Builder
+	sb.WriteString("__")
+	for _, r := range name {
+		switch {
+		case r == '_':
+			sb.WriteString("__")
+		case isLuaNameChar(r):
+			sb.WriteRune(r)
+		case r <= 0xffff:
+			sb.WriteString(fmt.Sprintf("_u%04x", r))
+		default:
+			sb.WriteString(fmt.Sprintf("_U%08x", r))
+		}
+	}
+	sb.WriteString("__")
+
+	return sb.String()
+}
+
+func needsMangling(name string) bool {
+	if luaKeywords[name] || luaGlobals[name] || runtimeNames[name] {
+		return true
+	}
+
+	return !isLuaName(name)
+}
+
+// isLuaName returns true if the name is a valid Lua identifier: it can be
+// used as a variable name or as a field name in "table.name" form.
+func isLuaName(name string) bool {
+	if name == "" || luaKeywords[name] {
+		return false
+	}
+
+	for idx, r := range name {
+		if !isLuaNameChar(r) || (idx == 0 && r >= '0' && r <= '9') {
+			return false
+		}
+	}
+
+	return true
+}
+
+func isLuaNameChar(r rune) bool {
+	return r == '_' ||
+		(r >= 'a' && r <= 'z') ||
+		(r >= 'A' && r <= 'Z') ||
+		(r >= '0' && r <= '9')
+}
@@ -0,0 +1,286 @@
+package tengo2lua
+
+import (
+	"strconv"
+
+	"github.com/d5/tengo/compiler/ast"
+	"github.com/d5/tengo/compiler/token"
+)
+
+// numericFor is a counting loop that can be converted into a Lua numeric
+// "for" statement:
+//
+//	for i := (init); i (op) (limit); i++ { (body) }
+//
+// is converted into:
+//
+//	for i = (init), (limit - 1) do (body) end
+type numericFor struct {
+	ident *ast.Ident
+	init  ast.Expr
+	op    token.Token
+	limit ast.Expr
+	step  int64
+}
+
+// analyzeNumericFor returns the numeric "for" loop equivalent to the loop
+// statement. It returns false if the loop is not a counting loop or if the
+// conversion would change its behavior:
+//   - the loop variable is assigned or captured by a function in the body
+//   - the limit expression may change while the loop runs
+//   - the loop variable may not be an integer with '<' or '>' conditions
+//
+// 'mutable' is a set of names assigned inside functions: such variables may
+// change whenever a function is called.
+func analyzeNumericFor(node *ast.ForStmt, mutable map[string]bool) (*numericFor, bool) {
+	// for i := (init)
+	init, ok := node.Init.(*ast.AssignStmt)
+	if !ok || init.Token != token.Define || len(init.LHS) != 1 || len(init.RHS) != 1 {
+		return nil, false
+	}
+	ident, ok := init.LHS[0].(*ast.Ident)
+	if !ok {
+		return nil, false
+	}
+	loop := &numericFor{ident: ident, init: init.RHS[0]}
+
+	// i (op) (limit)
+	cond, ok := node.Cond.(*ast.BinaryExpr)
+	if !ok || !isIdentNamed(cond.LHS, ident.Name) {
+		return nil, false
+	}
+	loop.op, loop.limit = cond.Token, cond.RHS
+
+	// i++, i--, i += (step), i -= (step)
+	switch post := node.Post.(type) {
+	case *ast.IncDecStmt:
+		if !isIdentNamed(post.Expr, ident.Name) {
+			return nil, false
+		}
+		loop.step = 1
+		if post.Token == token.Dec {
+			loop.step = -1
+		}
+	case *ast.AssignStmt:
+		if len(post.LHS) != 1 || len(post.RHS) != 1 || !isIdentNamed(post.LHS[0], ident.Name) {
+			return nil, false
+		}
+		step, ok := intLitValue(post.RHS[0])
+		if !ok || step <= 0 {
+			return nil, false
+		}
+		switch post.Token {
+		case token.AddAssign:
+			loop.step = step
+		case token.SubAssign:
+			loop.step = -step
+		default:
+			return nil, false
+		}
+	default:
+		return nil, false
+	}
+
+	// the direction of the loop must match the condition
+	switch loop.op {
+	case token.Less, token.LessEq:
+		if loop.step < 0 {
+			return nil, false
+		}
+	case token.Greater, token.GreaterEq:
+		if loop.step > 0 {
+			return nil, false
+		}
+	default:
+		return nil, false
+	}
+
+	// 'i < n' is converted into 'i <= n-1', which is equivalent only if 'i'
+	// is always an integer.
+	if loop.op == token.Less || loop.op == token.Greater {
+		if _, ok := intLitValue(loop.init); !ok {
+			return nil, false
+		}
+	}
+
+	if referencesName(loop.limit, ident.Name) || !isInvariant(loop.limit, node.Body, mutable) {
+		return nil, false
+	}
+
+	// the loop variable must not be assigned or captured in the body
+	valid := true
+	inspect(node.Body, func(n ast.Node) bool {
+		switch n := n.(type) {
+		case *ast.AssignStmt:
+			for _, lhs := range n.LHS {
+				if name, _ := resolveAssignLHS(lhs); name == ident.Name {
+					valid = false
+				}
+			}
+		case *ast.IncDecStmt:
+			if name, _ := resolveAssignLHS(n.Expr); name == ident.Name {
+				valid = false
+			}
+		case *ast.FuncLit:
+			if referencesName(n, ident.Name) {
+				valid = false
+			}
+		}
+		return valid
+	})
+	if !valid {
+		return nil, false
+	}
+
+	return loop, true
+}
+
+// isInvariant returns true if the value of the expression cannot change while
+// the loop body runs.
+func isInvariant(expr ast.Expr, body *ast.BlockStmt, mutable map[string]bool) bool {
+	switch expr := expr.(type) {
+	case *ast.IntLit, *ast.FloatLit:
+		return true
+	case *ast.ParenExpr:
+		return isInvariant(expr.Expr, body, mutable)
+	case *ast.UnaryExpr:
+		return expr.Token == token.Sub && isInvariant(expr.Expr, body, mutable)
+	case *ast.BinaryExpr:
+		switch expr.Token {
+		case token.Add, token.Sub, token.Mul:
+			return isInvariant(expr.LHS, body, mutable) && isInvariant(expr.RHS, body, mutable)
+		}
+	case *ast.Ident:
+		if mutable[expr.Name] {
+			return false
+		}
+		assigned := false
+		inspect(body, func(n ast.Node) bool {
+			switch n := n.(type) {
+			case *ast.AssignStmt:
+				for _, lhs := range n.LHS {
+					if name, _ := resolveAssignLHS(lhs); name == expr.Name {
+						assigned = true
+					}
+				}
+			case *ast.IncDecStmt:
+				if name, _ := resolveAssignLHS(n.Expr); name == expr.Name {
+					assigned = true
+				}
+			}
+			return !assigned
+		})
+		return !assigned
+	}
+
+	return false
+}
+
+// assignedInFuncs returns a set of variable names that are assigned inside
+// function literals.
+func assignedInFuncs(file *ast.File) map[string]bool {
+	names := make(map[string]bool)
+	inspect(file, func(n ast.Node) bool {
+		fn, ok := n.(*ast.FuncLit)
+		if !ok {
+			return true
+		}
+		inspect(fn.Body, func(n ast.Node) bool {
+			switch n := n.(type) {
+			case *ast.AssignStmt:
+				for _, lhs := range n.LHS {
+					name, _ := resolveAssignLHS(lhs)
+					names[name] = true
+				}
+			case *ast.IncDecStmt:
+				name, _ := resolveAssignLHS(n.Expr)
+				names[name] = true
+			}
+			return true
+		})
+		return false
+	})
+	return names
+}
+
+// referencesName returns true if the node has an identifier with the name.
+func referencesName(node ast.Node, name string) bool {
+	found := false
+	inspect(node, func(n ast.Node) bool {
+		if ident, ok := n.(*ast.Ident); ok && ident.Name == name {
+			found = true
+		}
+		return !found
+	})
+	return found
+}
+
+func isIdentNamed(expr ast.Expr, name string) bool {
+	ident, ok := expr.(*ast.Ident)
+	return ok && ident.Name == name
+}
+
+// intLitValue returns the value of an integer literal, optionally negated.
+func intLitValue(expr ast.Expr) (int64, bool) {
+	switch expr := expr.(type) {
+	case *ast.IntLit:
+		v, err := strconv.ParseInt(expr.Literal, 0, 64)
+		return v, err == nil
+	case *ast.UnaryExpr:
+		if expr.Token == token.Sub {
+			v, ok := intLitValue(expr.Expr)
+			return -v, ok
+		}
+	}
+	return 0, false
+}
+
+// convertNumericFor converts a counting loop into a Lua numeric "for" loop.
+func (t *Transpiler) convertNumericFor(loop *numericFor, body *ast.BlockStmt) (luaBlock, error) {
+	// the initial value is evaluated before the loop variable is defined
+	pre, init, err := t.convertHoisted(loop.init)
+	if err != nil {
+		return nil, err
+	}
+
+	limit, err := t.convertExpr(loop.limit)
+	if err != nil {
+		return nil, err
+	}
+
+	// for integer 'i': i < n  <=>  i <= ceil(n)-1
+	//                  i > n  <=>  i >= floor(n)+1
+	switch loop.op {
+	case token.Less:
+		if n, ok := intLitValue(loop.limit); ok {
+			limit = &luaLiteral{text: strconv.FormatInt(n-1, 10)}
+		} else {
+			limit = &luaBinary{op: "-", left: &luaCall{fn: luaNameIndex("math", "ceil"), args: []luaExpr{limit}}, right: &luaLiteral{text: "1"}}
+		}
+	case token.Greater:
+		if n, ok := intLitValue(loop.limit); ok {
+			limit = &luaLiteral{text: strconv.FormatInt(n+1, 10)}
+		} else {
+			limit = &luaBinary{op: "+", left: &luaCall{fn: luaNameIndex("math", "floor"), args: []luaExpr{limit}}, right: &luaLiteral{text: "1"}}
+		}
+	}
+
+	if err := t.defineVar(loop.ident); err != nil {
+		return nil, err
+	}
+
+	// for i = (init), (limit), (step) do
+	//   (body)
+	// end
+	forStmt := &luaNumericFor{name: LuaName(loop.ident.Name), start: init, limit: limit}
+	if loop.step != 1 {
+		forStmt.step = &luaLiteral{text: strconv.FormatInt(loop.step, 10)}
+	}
+
+	forStmt.body, err = t.convertLoopBody(body, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	return append(pre, forStmt), nil
+}
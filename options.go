@@ -9,6 +9,89 @@ type Options struct {
 
 	// Indent string is added whenever the block level increases.
 	Indent string
+
+	// Minify generates compact code: redundant whitespace and parentheses
+	// are removed, local variables and function parameters get short names
+	// and unused helper functions are left out. The minified code behaves
+	// exactly like the non-minified one. Each statement is still written on
+	// its own line. Indent is ignored.
+	Minify bool
+
+	// FoldConstants evaluates constant expressions (e.g. "60 * 60 * 24" or
+	// "a" + "b") at conversion time, with Tengo semantics, and removes the
+	// branches and the loops whose conditions are constant. The conditions
+	// and the logical operators keep the Lua truthiness of the converted
+	// code.
+	FoldConstants bool
+
+	// HelperPrefix is inserted in the names of the helper functions and the
+	// builtin functions the converted code defines, e.g. "__<prefix>len__".
+	// The functions are local variables of the converted chunk; the prefix
+	// is only needed to tell them apart in stack traces. It may only contain
+	// letters, digits and underscores.
+	HelperPrefix string
+
+	// Builtins are builtin functions of the converted code in addition to
+	// the default ones ("len"). A builtin with the name of a default one
+	// replaces it.
+	Builtins []Builtin
+
+	// HostGlobals are names the host provides to the converted code, like
+	// the builtin functions. Variables of the script can shadow them.
+	HostGlobals []HostGlobal
+
+	// HostTable is the name (or dotted path) of the Lua global table that
+	// holds the HostGlobals. If it's empty, the HostGlobals are Lua global
+	// variables.
+	HostTable string
+
+	// HostAPI declares the types of the host functions and variables, and
+	// the host constants. See ParseHostAPI.
+	HostAPI *HostAPI
+
+	// InputTable enables the input mode: the variables the script uses
+	// without defining them are the inputs of the script (see
+	// Transpiler.Inputs), read from and written to the fields of the Lua
+	// global table InputTable.
+	InputTable string
+
+	// CallRules rewrite the calls to some functions into Lua expressions.
+	// The global names the templates refer to must be standard Lua globals
+	// or listed in AllowedGlobals to pass ValidateOutput.
+	CallRules []CallRule
+
+	// Hooks override or decorate the conversion of the statements and the
+	// expressions of the script. See Hook.
+	Hooks []Hook
+
+	// Runtime selects how the converted code gets the helper functions and
+	// the builtin functions: defined inline (default), loaded with "require"
+	// or provided by the host. See RuntimeModule.
+	Runtime RuntimeMode
+
+	// RuntimeName is the name of the runtime module: the module name passed
+	// to "require" in the RuntimeRequire mode, or the name of the global
+	// variable that holds the module in the RuntimeHost mode. It defaults to
+	// DefaultRuntimeName.
+	RuntimeName string
+
+	// Target is the Lua dialect of the generated code.
+	Target LuaVersion
+
+	// Environment is a Lua expression of the table used as the global
+	// environment of the converted code, after the helper functions are
+	// defined. It's set with "setfenv" in Lua 5.1 and LuaJIT, and with a
+	// local "_ENV" variable in the other dialects.
+	Environment string
+
+	// ValidateOutput makes Transpiler parse its own output and check it for
+	// references to undeclared global variables. Any problem found is
+	// reported as a transpiler bug at the offending Tengo position.
+	ValidateOutput bool
+
+	// AllowedGlobals is a list of global names the host provides to the
+	// converted code. It's used only when ValidateOutput is enabled.
+	AllowedGlobals []string
 }
 
 // DefaultOptions creates a default option for Transpiler.
@@ -16,5 +99,7 @@ func DefaultOptions() *Options {
 	return &Options{
 		EnableGlobalScope: false,
 		Indent:            "  ",
+		FoldConstants:     false,
+		Target:            Lua51,
 	}
 }
@@ -0,0 +1,94 @@
+package tengo2lua
+
+import "strings"
+
+// Lua operator precedence, from lower to higher.
+const (
+	precOr = iota + 1
+	precAnd
+	precCompare // < > <= >= ~= ==
+	precBor     // |
+	precBxor    // ~
+	precBand    // &
+	precShift   // << >>
+	precConcat  // ..
+	precAdd     // + -
+	precMul     // * / // %
+	precUnary   // not # - ~
+	precPow     // ^
+	precAtom    // names, literals, function calls, parenthesized expressions
+)
+
+// binaryPrec maps Lua binary operators to their precedence.
+var binaryPrec = map[string]int{
+	"or":  precOr,
+	"and": precAnd,
+	"<":   precCompare,
+	">":   precCompare,
+	"<=":  precCompare,
+	">=":  precCompare,
+	"~=":  precCompare,
+	"==":  precCompare,
+	"|":   precBor,
+	"~":   precBxor,
+	"&":   precBand,
+	"<<":  precShift,
+	">>":  precShift,
+	"..":  precConcat,
+	"+":   precAdd,
+	"-":   precAdd,
+	"*":   precMul,
+	"/":   precMul,
+	"//":  precMul,
+	"%":   precMul,
+	"^":   precPow,
+}
+
+// exprPrec returns the precedence of a Lua expression.
+func exprPrec(expr luaExpr) int {
+	switch expr := expr.(type) {
+	case *luaBinary:
+		return binaryPrec[expr.op]
+	case *luaUnary:
+		return precUnary
+	case *luaTemplate:
+		// the template is an arbitrary expression
+		return 0
+	case *luaLiteral:
+		// negative numbers
+		if strings.HasPrefix(expr.text, "-") {
+			return precUnary
+		}
+	}
+	return precAtom
+}
+
+// isRightAssoc returns true for the right associative Lua operators.
+func isRightAssoc(op string) bool {
+	return op == ".." || op == "^"
+}
+
+// isPrefixExpr returns true if the expression can be used as a callee or as
+// the container of an index expression without parentheses.
+func isPrefixExpr(expr luaExpr) bool {
+	switch expr.(type) {
+	case *luaName, *luaIndex, *luaCall, *luaParen:
+		return true
+	}
+	return false
+}
+
+// startsWithParen returns true if the printed expression starts with "(".
+// Such a call statement could be parsed as a continuation of the previous
+// statement.
+func startsWithParen(expr luaExpr) bool {
+	switch expr := expr.(type) {
+	case *luaName:
+		return false
+	case *luaIndex:
+		return startsWithParen(expr.obj)
+	case *luaCall:
+		return startsWithParen(expr.fn)
+	}
+	return true
+}
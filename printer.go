@@ -0,0 +1,410 @@
+package tengo2lua
+
+import (
+	"strings"
+
+	"github.com/d5/tengo/compiler/source"
+)
+
+// luaPrinter prints Lua AST as Lua source code. It also records the Tengo
+// position of each printed line.
+//
+// In minified mode, the printer writes each statement on a single line without
+// indentation and omits all optional spaces.
+type luaPrinter struct {
+	indent  string
+	minify  bool
+	level   int
+	sb      strings.Builder
+	last    string
+	pos     source.Pos
+	linePos []source.Pos
+}
+
+// printLua prints the Lua chunk. It returns the code and the Tengo position
+// of each of its lines.
+func printLua(chunk luaBlock, indent string, minify bool) (string, []source.Pos) {
+	p := &luaPrinter{indent: indent, minify: minify}
+	if minify {
+		p.indent = ""
+	}
+	for _, stmt := range chunk {
+		p.stmt(stmt)
+	}
+	return p.sb.String(), p.linePos
+}
+
+// write writes tokens. A space is inserted between two tokens that would
+// otherwise be read as a single token.
+func (p *luaPrinter) write(tokens ...string) {
+	for _, tok := range tokens {
+		if tok == "" {
+			continue
+		}
+		if needsSpace(p.last, tok) {
+			p.sb.WriteByte(' ')
+		}
+		p.sb.WriteString(tok)
+		p.last = tok
+	}
+}
+
+// space writes an optional space.
+func (p *luaPrinter) space() {
+	if !p.minify {
+		p.sb.WriteByte(' ')
+		p.last = " "
+	}
+}
+
+// startLine writes the indentation of a new line.
+func (p *luaPrinter) startLine() {
+	p.sb.WriteString(strings.Repeat(p.indent, p.level))
+}
+
+// endLine ends the current line.
+func (p *luaPrinter) endLine() {
+	p.sb.WriteByte('\n')
+	p.last = "\n"
+	p.linePos = append(p.linePos, p.pos)
+}
+
+func (p *luaPrinter) block(block luaBlock) {
+	p.level++
+	for _, stmt := range block {
+		p.stmt(stmt)
+	}
+	p.level--
+}
+
+func (p *luaPrinter) stmt(stmt luaStmt) {
+	if pos := stmt.position(); pos != source.NoPos {
+		prevPos := p.pos
+		p.pos = pos
+		defer func() { p.pos = prevPos }()
+	}
+
+	if raw, ok := stmt.(*luaRawStmt); ok {
+		for _, line := range strings.Split(strings.TrimSuffix(raw.code, "\n"), "\n") {
+			p.write(line)
+			p.endLine()
+		}
+		return
+	}
+
+	p.startLine()
+
+	switch stmt := stmt.(type) {
+	case *luaLocal:
+		p.write("local", strings.Join(stmt.names, ","))
+		if len(stmt.values) > 0 {
+			p.write("=")
+			p.exprList(stmt.values)
+		}
+
+	case *luaAssign:
+		p.exprList(stmt.targets)
+		p.write("=")
+		p.exprList(stmt.values)
+
+	case *luaCallStmt:
+		p.expr(stmt.call, 0)
+
+	case *luaDo:
+		p.write("do")
+		p.endLine()
+		p.block(stmt.body)
+		p.startLine()
+		p.write("end")
+
+	case *luaWhile:
+		p.write("while")
+		p.space()
+		p.expr(stmt.cond, 0)
+		p.space()
+		p.write("do")
+		p.endLine()
+		p.block(stmt.body)
+		p.startLine()
+		p.write("end")
+
+	case *luaRepeat:
+		p.write("repeat")
+		p.endLine()
+		p.block(stmt.body)
+		p.startLine()
+		p.write("until")
+		p.space()
+		p.expr(stmt.cond, 0)
+
+	case *luaIf:
+		p.write("if")
+		p.space()
+		p.expr(stmt.cond, 0)
+		p.space()
+		p.write("then")
+		p.endLine()
+		p.block(stmt.body)
+		if stmt.els != nil {
+			p.startLine()
+			p.write("else")
+			p.endLine()
+			p.block(stmt.els)
+		}
+		p.startLine()
+		p.write("end")
+
+	case *luaNumericFor:
+		p.write("for", stmt.name)
+		p.space()
+		p.write("=")
+		p.space()
+		p.expr(stmt.start, 0)
+		p.write(",")
+		p.space()
+		p.expr(stmt.limit, 0)
+		if stmt.step != nil {
+			p.write(",")
+			p.space()
+			p.expr(stmt.step, 0)
+		}
+		p.space()
+		p.write("do")
+		p.endLine()
+		p.block(stmt.body)
+		p.startLine()
+		p.write("end")
+
+	case *luaGenericFor:
+		p.write("for")
+		for idx, name := range stmt.names {
+			if idx > 0 {
+				p.write(",")
+				p.space()
+			}
+			p.write(name)
+		}
+		p.write("in")
+		p.space()
+		p.exprList(stmt.exprs)
+		p.space()
+		p.write("do")
+		p.endLine()
+		p.block(stmt.body)
+		p.startLine()
+		p.write("end")
+
+	case *luaReturn:
+		p.write("return")
+		if len(stmt.values) > 0 {
+			p.space()
+			p.exprList(stmt.values)
+		}
+
+	case *luaBreak:
+		p.write("break")
+
+	case *luaGoto:
+		p.write("goto", stmt.label)
+
+	case *luaLabel:
+		p.write("::", stmt.name, "::")
+
+	case *luaTemplateStmt:
+		p.template(stmt.tmpl)
+	}
+
+	p.endLine()
+}
+
+func (p *luaPrinter) exprList(exprs []luaExpr) {
+	for idx, expr := range exprs {
+		if idx > 0 {
+			p.write(",")
+		}
+		p.expr(expr, 0)
+	}
+}
+
+// expr prints an expression. It's enclosed in parentheses if its precedence
+// is lower than minPrec.
+func (p *luaPrinter) expr(expr luaExpr, minPrec int) {
+	if exprPrec(expr) < minPrec {
+		p.write("(")
+		defer p.write(")")
+	}
+
+	switch expr := expr.(type) {
+	case *luaName:
+		p.write(expr.name)
+
+	case *luaLiteral:
+		p.write(expr.text)
+
+	case *luaStringLit:
+		p.write(luaString(expr.value))
+
+	case *luaTable:
+		p.write("{")
+		for idx, field := range expr.fields {
+			if idx > 0 {
+				p.write(",")
+			}
+			if key, ok := field.key.(*luaStringLit); ok && isLuaName(key.value) {
+				p.write(key.value, "=")
+			} else if field.key != nil {
+				p.write("[")
+				p.expr(field.key, 0)
+				p.write("]=")
+			}
+			p.expr(field.value, 0)
+		}
+		p.write("}")
+
+	case *luaIndex:
+		p.prefixExpr(expr.obj)
+		if key, ok := expr.key.(*luaStringLit); ok && isLuaName(key.value) {
+			p.write(".", key.value)
+		} else {
+			p.write("[")
+			p.expr(expr.key, 0)
+			p.write("]")
+		}
+
+	case *luaCall:
+		p.prefixExpr(expr.fn)
+		p.write("(")
+		p.exprList(expr.args)
+		p.write(")")
+
+	case *luaFunction:
+		p.write("function(", strings.Join(expr.params, ","), ")")
+		p.endLine()
+		p.block(expr.body)
+		p.startLine()
+		p.write("end")
+
+	case *luaBinary:
+		prec := binaryPrec[expr.op]
+		leftPrec, rightPrec := prec, prec+1
+		if expr.op == ".." {
+			// concatenation is associative
+			leftPrec = prec
+		} else if isRightAssoc(expr.op) {
+			leftPrec, rightPrec = prec+1, prec
+		}
+		p.expr(expr.left, leftPrec)
+		p.space()
+		p.write(expr.op)
+		p.space()
+		p.expr(expr.right, rightPrec)
+
+	case *luaUnary:
+		p.write(expr.op)
+		if expr.op == "not" {
+			p.space()
+		}
+		p.expr(expr.expr, precUnary)
+
+	case *luaParen:
+		p.write("(")
+		p.expr(expr.expr, 0)
+		p.write(")")
+
+	case *luaTemplate:
+		p.template(expr)
+	}
+}
+
+// template prints a template. The lines of its code after the first one are
+// indented to the current level.
+func (p *luaPrinter) template(tmpl *luaTemplate) {
+	for idx, part := range tmpl.parts {
+		for lineIdx, line := range strings.Split(part, "\n") {
+			if lineIdx > 0 {
+				p.endLine()
+				p.startLine()
+			}
+			p.write(line)
+		}
+		if idx == len(tmpl.args) {
+			break
+		}
+		if args := tmpl.args[idx]; len(args) == 1 {
+			p.expr(args[0], precAtom)
+		} else {
+			p.exprList(args)
+		}
+	}
+}
+
+// prefixExpr prints an expression used as a callee or as the container of an
+// index expression.
+func (p *luaPrinter) prefixExpr(expr luaExpr) {
+	if isPrefixExpr(expr) {
+		p.expr(expr, 0)
+		return
+	}
+	p.write("(")
+	p.expr(expr, 0)
+	p.write(")")
+}
+
+// needsSpace returns true if two adjacent tokens must be separated by a
+// space.
+func needsSpace(prev, next string) bool {
+	if prev == "" {
+		return false
+	}
+	last := prev[len(prev)-1]
+
+	switch {
+	case isLuaNameChar(rune(last)) && isLuaNameChar(rune(next[0])):
+		// names, keywords and numbers
+		return true
+	case isNumber(prev) && next[0] == '.':
+		return true
+	case last == '-' && next[0] == '-':
+		// "--" starts a comment
+		return true
+	case last == '[' && (next[0] == '[' || next[0] == '='):
+		// "[[" and "[=" start a long string
+		return true
+	case last == '.' && (next[0] == '.' || isDigit(next[0])):
+		return true
+	case strings.IndexByte("<>=~/:", last) >= 0 && (next[0] == '=' || next[0] == last):
+		return true
+	}
+	return false
+}
+
+// minifyLua removes comments and redundant whitespace from Lua code.
+func minifyLua(code string) string {
+	var sb strings.Builder
+	var last string
+	newline := false
+	for _, tok := range luaTokenize(code) {
+		if tok.kind == tokSpace {
+			newline = newline || strings.Contains(tok.text, "\n")
+			continue
+		}
+
+		// a line break before "(" avoids the ambiguity of function calls
+		// in Lua 5.1
+		if newline && tok.text[0] == '(' {
+			sb.WriteByte('\n')
+		} else if needsSpace(last, tok.text) {
+			sb.WriteByte(' ')
+		}
+		sb.WriteString(tok.text)
+		last = tok.text
+		newline = false
+	}
+	return sb.String()
+}
+
+// isNumber returns true if the token is a numeric literal, possibly negative.
+func isNumber(tok string) bool {
+	tok = strings.TrimPrefix(tok, "-")
+	return tok != "" && (isDigit(tok[0]) || (len(tok) > 1 && tok[0] == '.' && isDigit(tok[1])))
+}
@@ -0,0 +1,131 @@
+package tengo2lua
+
+import (
+	"fmt"
+	"strings"
+)
+
+// RuntimeMode selects how the converted code gets the helper functions and
+// the builtin functions it uses.
+type RuntimeMode int
+
+// List of runtime modes
+const (
+	// RuntimeInline defines the functions at the top of each converted
+	// chunk.
+	RuntimeInline RuntimeMode = iota
+
+	// RuntimeRequire loads the runtime module generated by RuntimeModule
+	// with "require(<Options.RuntimeName>)".
+	RuntimeRequire
+
+	// RuntimeHost reads the runtime module from the global variable
+	// Options.RuntimeName, which the host sets before running the converted
+	// code.
+	RuntimeHost
+)
+
+// RuntimeVersion is the version of the runtime module. It changes whenever
+// the functions of the runtime change.
+const RuntimeVersion = 1
+
+// DefaultRuntimeName is the name of the runtime module used when
+// Options.RuntimeName is empty.
+const DefaultRuntimeName = "tengo2lua"
+
+// runtimeVersion returns the version string of the runtime module. The
+// runtime depends on the target, so a module generated for another target is
+// rejected as well.
+func runtimeVersion(target LuaVersion) string {
+	return fmt.Sprintf("%d (%s)", RuntimeVersion, target)
+}
+
+// runtimeName returns the name of the runtime module.
+func (o *Options) runtimeName() string {
+	if o.RuntimeName == "" {
+		return DefaultRuntimeName
+	}
+	return o.RuntimeName
+}
+
+// RuntimeModule returns a standalone Lua module that defines all the helper
+// functions and the builtin functions, including Options.Builtins, for the
+// target of the options. Code converted in the RuntimeRequire or the
+// RuntimeHost mode checks the version of the module before using it.
+func RuntimeModule(opts *Options) (string, error) {
+	if opts == nil {
+		opts = DefaultOptions()
+	}
+
+	prelude, err := newPrelude(opts)
+	if err != nil {
+		return "", err
+	}
+
+	helpersUsed := make(map[helper]bool)
+	for h := range helperNames {
+		helpersUsed[h] = helperSupported(h, opts.Target)
+	}
+	builtinsUsed := make(map[string]bool)
+	for name, fn := range prelude {
+		builtinsUsed[name] = fn.builtin
+	}
+	names := preludeNames(helpersUsed, builtinsUsed)
+
+	luaName := func(name string) string {
+		return "__" + name + "__"
+	}
+
+	var sb strings.Builder
+	sb.WriteString(preludeCode(prelude, names, luaName))
+	sb.WriteString("return {\n")
+	sb.WriteString(opts.Indent + "version = " + luaString(runtimeVersion(opts.Target)) + ",\n")
+	for _, name := range names {
+		sb.WriteString(opts.Indent + luaFieldKey(name) + " = " + luaName(name) + ",\n")
+	}
+	sb.WriteString("}\n")
+
+	if opts.Minify {
+		return minifyLua(sb.String()), nil
+	}
+	return sb.String(), nil
+}
+
+// luaFieldKey returns the key of a table constructor field.
+func luaFieldKey(name string) string {
+	if isLuaName(name) {
+		return name
+	}
+	return "[" + luaString(name) + "]"
+}
+
+// runtimeImport returns the prelude that loads the runtime module, checks its
+// version and defines the functions the converted code uses as local
+// variables.
+func (t *Transpiler) runtimeImport(names []string) string {
+	var module string
+	if t.options.Runtime == RuntimeRequire {
+		module = "require(" + luaString(t.options.runtimeName()) + ")"
+	} else {
+		module = t.options.runtimeName()
+	}
+
+	runtime := t.runtimeName("runtime")
+	version := luaString(runtimeVersion(t.options.Target))
+
+	var sb strings.Builder
+	sb.WriteString("local " + runtime + " = " + module + "\n")
+	sb.WriteString("if " + runtime + ".version ~= " + version + " then\n")
+	sb.WriteString(t.options.Indent + "error(" + luaString("incompatible runtime, expected version "+runtimeVersion(t.options.Target)) + ")\n")
+	sb.WriteString("end\n")
+
+	for _, name := range names {
+		field := "." + name
+		if !isLuaName(name) {
+			field = "[" + luaString(name) + "]"
+		}
+		sb.WriteString("local " + t.runtimeName(name) + " = " + runtime + field + "\n")
+	}
+
+	return sb.String()
+}
@@ -0,0 +1,116 @@
+package tengo2lua
+
+// LuaVersion represents a Lua dialect targeted by Transpiler.
+type LuaVersion int
+
+// List of Lua dialects
+const (
+	Lua51 LuaVersion = iota
+	Lua52
+	Lua53
+	Lua54
+	LuaJIT
+)
+
+func (v LuaVersion) String() string {
+	switch v {
+	case Lua51:
+		return "Lua 5.1"
+	case Lua52:
+		return "Lua 5.2"
+	case Lua53:
+		return "Lua 5.3"
+	case Lua54:
+		return "Lua 5.4"
+	case LuaJIT:
+		return "LuaJIT"
+	default:
+		return "unknown Lua version"
+	}
+}
+
+// hasGoto returns true if the dialect supports "goto" statements and labels.
+func (v LuaVersion) hasGoto() bool {
+	return v != Lua51
+}
+
+// hasIntegers returns true if the dialect has a native integer subtype, the
+// floor division operator ("//") and the native bitwise operators.
+func (v LuaVersion) hasIntegers() bool {
+	return v == Lua53 || v == Lua54
+}
+
+// bitLibrary returns the name of the library that provides bitwise
+// operations in the dialects without native bitwise operators.
+func (v LuaVersion) bitLibrary() string {
+	switch v {
+	case Lua52:
+		return "bit32"
+	case LuaJIT:
+		return "bit"
+	default:
+		return ""
+	}
+}
+
+// hasSetfenv returns true if the environment of a function is set with
+// "setfenv" rather than with the "_ENV" variable.
+func (v LuaVersion) hasSetfenv() bool {
+	return v == Lua51 || v == LuaJIT
+}
+
+// environmentCode returns the statement that sets the global environment of
+// the converted code, or "" if Options.Environment is empty.
+func (t *Transpiler) environmentCode() string {
+	env := t.options.Environment
+	if env == "" {
+		return ""
+	}
+	if t.options.Target.hasSetfenv() {
+		return "setfenv(1, " + env + ")\n"
+	}
+	return "local _ENV = " + env + "\n"
+}
+
+// globals returns a set of global names provided by the standard libraries
+// of the dialect.
+func (v LuaVersion) globals() map[string]bool {
+	names := map[string]bool{}
+	for name := range commonLuaGlobals {
+		names[name] = true
+	}
+
+	switch v {
+	case Lua51:
+		addNames(names, "getfenv", "setfenv", "loadstring", "module", "unpack")
+	case Lua52:
+		addNames(names, "rawlen", "bit32")
+	case Lua53:
+		addNames(names, "rawlen", "utf8")
+	case Lua54:
+		addNames(names, "rawlen", "utf8")
+	case LuaJIT:
+		addNames(names, "getfenv", "setfenv", "loadstring", "module", "unpack", "bit", "jit")
+	}
+
+	return names
+}
+
+// commonLuaGlobals is a set of global names provided by the standard
+// libraries of all supported Lua dialects.
+var commonLuaGlobals = map[string]bool{
+	"_G": true, "_VERSION": true, "assert": true, "collectgarbage": true,
+	"dofile": true, "error": true, "getmetatable": true, "ipairs": true,
+	"load": true, "loadfile": true, "next": true, "pairs": true, "pcall": true,
+	"print": true, "rawequal": true, "rawget": true, "rawset": true,
+	"require": true, "select": true, "setmetatable": true, "tonumber": true,
+	"tostring": true, "type": true, "xpcall": true, "coroutine": true,
+	"debug": true, "io": true, "math": true, "os": true, "package": true,
+	"string": true, "table": true,
+}
+
+func addNames(set map[string]bool, names ...string) {
+	for _, name := range names {
+		set[name] = true
+	}
+}
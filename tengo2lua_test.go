@@ -14,21 +14,33 @@ type ARR = []interface{}
 type MAP = map[string]interface{}
 
 func convertEval(t *testing.T, src string, expected interface{}) {
-	ls := convert(t, src)
+	convertEvalOpts(t, src, testOptions(), expected)
+}
+
+func convertEvalOpts(t *testing.T, src string, opts *tengo2lua.Options, expected interface{}) {
+	ls := convertOpts(t, src, opts)
 	if !eval(t, ls, expected) {
 		t.Logf("Lua Script:\n%s\n", ls)
 	}
 }
 
 func convert(t *testing.T, src string) string {
-	tr := tengo2lua.NewTranspiler([]byte(src), nil)
+	return convertOpts(t, src, testOptions())
+}
+
+func convertOpts(t *testing.T, src string, opts *tengo2lua.Options) string {
+	tr := tengo2lua.NewTranspiler([]byte(src), opts)
 	out, err := tr.Convert()
 	assert.NoError(t, err)
 	return out
 }
 
 func convertError(t *testing.T, src, expected string) {
-	tr := tengo2lua.NewTranspiler([]byte(src), nil)
+	convertErrorOpts(t, src, testOptions(), expected)
+}
+
+func convertErrorOpts(t *testing.T, src string, opts *tengo2lua.Options, expected string) {
+	tr := tengo2lua.NewTranspiler([]byte(src), opts)
 	ls, err := tr.Convert()
 	if !assert.Error(t, err) {
 		t.Logf("Lua Script:\n%s\n", ls)
@@ -37,6 +49,14 @@ func convertError(t *testing.T, src, expected string) {
 	assert.True(t, strings.Contains(err.Error(), expected), "expected: %s, got: %s", expected, err.Error())
 }
 
+// testOptions returns the options used by the tests: the transpiler
+// validates all of its output.
+func testOptions() *tengo2lua.Options {
+	opts := tengo2lua.DefaultOptions()
+	opts.ValidateOutput = true
+	return opts
+}
+
 func eval(t *testing.T, luaScript string, expected interface{}) bool {
 	l := lua.NewState()
 	defer l.Close()
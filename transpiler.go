@@ -3,8 +3,6 @@ package tengo2lua
 import (
 	"fmt"
 	"regexp"
-	"strconv"
-	"strings"
 
 	"github.com/d5/tengo/compiler"
 	"github.com/d5/tengo/compiler/ast"
@@ -23,8 +21,15 @@ type Transpiler struct {
 	file             *source.File
 	symbolTable      *compiler.SymbolTable
 	loopDepth        int
-	indentLevel      int
+	funcAssigned     map[string]bool
+	hoist            *hoistState
+	tempCount        int
 	options          *Options
+	types            map[ast.Expr]Type
+	prelude          map[string]*preludeFunc
+	hostGlobals      map[string][]string
+	inputs           map[string]*Input
+	callRules        map[string]*callTemplate
 	builtinFuncsUsed map[string]bool
 	helpersUsed      map[helper]bool
 }
@@ -50,229 +55,278 @@ func NewTranspiler(src []byte, opts *Options) *Transpiler {
 
 // Convert converts the input Tengo source code.
 func (t *Transpiler) Convert() (output string, err error) {
+	if err = t.init(); err != nil {
+		return
+	}
+
 	astFile, err := t.parse()
 	if err != nil {
 		return
 	}
 
-	t.indentLevel = 0
+	if t.options.FoldConstants {
+		t.foldConstants(astFile)
+	}
 
-	output, err = t.convert(astFile)
+	t.funcAssigned = assignedInFuncs(astFile)
+	t.types = inferTypes(astFile, t.prelude, t.options.HostAPI)
+
+	chunk, err := t.convertStmts(astFile.Stmts, true)
 	if err != nil {
 		return
 	}
 
-	output = t.helperCode() + output
+	if t.options.Minify {
+		t.pruneHelpers(minifyChunk(chunk))
+	}
 
-	// TODO: add option to minify the output code
-	// e.g. remove all redundant whitespaces
-	// ...
+	if helpers := t.helperCode() + t.environmentCode(); helpers != "" {
+		if t.options.Minify {
+			helpers = minifyLua(helpers)
+		}
+		chunk = append(luaBlock{&luaRawStmt{code: helpers}}, chunk...)
+	}
+
+	output, linePos := printLua(chunk, t.options.Indent, t.options.Minify)
+
+	if t.options.ValidateOutput {
+		if err = t.validate(output, linePos); err != nil {
+			return
+		}
+	}
 
 	return
 }
 
-// TODO: helper functions should be added selectively
-// e.g. add __iter__ only when the code actually had "for-in" statement.
-func (t *Transpiler) helperCode() string {
-	var out string
+// init checks the options and sets up the helpers and the builtin functions.
+func (t *Transpiler) init() error {
+	if !isLuaName(t.runtimeName("")) {
+		return fmt.Errorf("invalid helper prefix '%s'", t.options.HelperPrefix)
+	}
+	if t.options.Runtime == RuntimeHost && !isLuaName(t.options.runtimeName()) {
+		return fmt.Errorf("invalid runtime global name '%s'", t.options.runtimeName())
+	}
 
-	for h, used := range t.helpersUsed {
-		if used {
-			out += helpers[h] + "\n"
-		}
+	prelude, err := newPrelude(t.options)
+	if err != nil {
+		return err
+	}
+	t.prelude = prelude
+
+	if t.options.InputTable != "" && !isLuaName(t.options.InputTable) {
+		return fmt.Errorf("invalid input table name '%s'", t.options.InputTable)
 	}
+	t.inputs = make(map[string]*Input)
 
-	for name, used := range t.builtinFuncsUsed {
-		if used {
-			out += name + " = " + builtinFunctions[name] + "\n"
+	t.callRules = make(map[string]*callTemplate)
+	for idx := range t.options.CallRules {
+		tmpl, err := newCallTemplate(&t.options.CallRules[idx], t.options.Minify)
+		if err != nil {
+			return err
 		}
+		t.callRules[tmpl.rule.Callee] = tmpl
 	}
 
-	return out
-}
+	t.hostGlobals = make(map[string][]string)
+	for _, g := range t.options.HostGlobals {
+		if t.isBuiltin(g.Name) {
+			return fmt.Errorf("host global '%s' conflicts with a builtin function", g.Name)
+		}
+		path, err := hostPath(t.options, g)
+		if err != nil {
+			return err
+		}
+		t.hostGlobals[g.Name] = path
+	}
 
-func (t *Transpiler) convert(node ast.Node) (string, error) {
-	switch node := node.(type) {
-	case *ast.File:
-		lines := ""
-		for _, stmt := range node.Stmts {
-			out, err := t.convert(stmt)
-			if err != nil {
-				return "", err
+	if api := t.options.HostAPI; api != nil {
+		var names []string
+		for name := range api.Funcs {
+			names = append(names, name)
+		}
+		for name := range api.Vars {
+			names = append(names, name)
+		}
+		for name := range api.Consts {
+			if t.isBuiltin(name) {
+				return fmt.Errorf("host constant '%s' conflicts with a builtin function", name)
 			}
-			lines += out
 		}
-		return lines + "\n", nil
 
-	case *ast.BlockStmt:
-		lines := ""
-		for _, stmt := range node.Stmts {
-			out, err := t.convert(stmt)
+		// the host globals may map the names
+		for _, name := range names {
+			if _, ok := t.hostGlobals[name]; ok {
+				continue
+			}
+			if t.isBuiltin(name) {
+				return fmt.Errorf("host global '%s' conflicts with a builtin function", name)
+			}
+			path, err := hostPath(t.options, HostGlobal{Name: name})
 			if err != nil {
-				return "", err
+				return err
 			}
-			lines += out
+			t.hostGlobals[name] = path
 		}
-		return lines, nil
-
-	case *ast.ExprStmt:
-		out, err := t.convert(node.Expr)
-		if err != nil {
-			return "", err
-		}
-
-		return t.line(out), nil
+	}
 
-	case *ast.IncDecStmt:
-		// expand to "expr = expr + 1"
-		expr, err := t.convert(node.Expr)
-		if err != nil {
-			return "", err
-		}
+	return nil
+}
 
-		op := "+"
-		if node.Token == token.Dec {
-			op = "-"
-		}
+// pruneHelpers removes the helpers and the builtin functions the minified
+// chunk does not refer to.
+func (t *Transpiler) pruneHelpers(free map[string]bool) {
+	for h, name := range helperNames {
+		t.helpersUsed[h] = t.helpersUsed[h] && free[t.runtimeName(name)]
+	}
 
-		return t.line(expr + "=" + expr + op + "1"), nil
+	for name := range t.builtinFuncsUsed {
+		t.builtinFuncsUsed[name] = t.builtinFuncsUsed[name] && free[t.runtimeName(name)]
+	}
+}
 
-	case *ast.AssignStmt:
-		out, err := t.convertAssignment(node, node.LHS, node.RHS, node.Token)
-		if err != nil {
-			return "", err
-		}
-		return t.line(out), nil
+// helperCode returns the prelude of the converted code: the helpers and the
+// builtin functions it uses, with their dependencies. They are either defined
+// inline or loaded from the external runtime, depending on the runtime mode.
+func (t *Transpiler) helperCode() string {
+	names := preludeNames(t.helpersUsed, t.builtinFuncsUsed)
+	if len(names) == 0 {
+		return ""
+	}
 
-	case *ast.ParenExpr:
-		expr, err := t.convert(node.Expr)
-		if err != nil {
-			return "", err
-		}
+	if t.options.Runtime == RuntimeInline {
+		return preludeCode(t.prelude, names, t.runtimeName)
+	}
 
-		return "(" + expr + ")", nil
+	return t.runtimeImport(names)
+}
 
-	case *ast.BinaryExpr:
-		left, err := t.convert(node.LHS)
-		if err != nil {
-			return "", err
-		}
-		right, err := t.convert(node.RHS)
-		if err != nil {
-			return "", err
-		}
+// runtimeName returns the Lua name of a helper or of a builtin function:
+// "__<prefix><name>__". Tengo does not allow such variable names, but
+// LuaName mangles the names of Lua keywords and globals (e.g. "print") the
+// same way, so "_b" is appended to those.
+func (t *Transpiler) runtimeName(name string) string {
+	name = t.options.HelperPrefix + name
+	if name != "" && needsMangling(name) {
+		name += "_b"
+	}
+	return "__" + name + "__"
+}
 
-		var op string
-		switch node.Token {
-		case token.LAnd:
-			op = "and"
-		case token.LOr:
-			op = "or"
-		case token.NotEqual:
-			op = "~="
-		case token.And, token.Or, token.Xor, token.AndNot, token.Shl, token.Shr:
-			// TODO: bitwise operators not supported
-			return "", t.error(node, "operator "+node.Token.String()+"not supported")
-		default:
-			op = node.Token.String()
-		}
+// isBuiltin returns true if the name is a builtin function.
+func (t *Transpiler) isBuiltin(name string) bool {
+	fn, ok := t.prelude[name]
+	return ok && fn.builtin
+}
 
-		// potentially string + operator was used
-		if node.Token == token.Add {
-			t.helpersUsed[helperStringConcat] = true
-		}
+// helperCall returns a call to a helper and marks the helper as used.
+func (t *Transpiler) helperCall(h helper, args ...luaExpr) *luaCall {
+	t.helpersUsed[h] = true
+	return luaCallName(t.runtimeName(helperNames[h]), args...)
+}
 
-		return "(" + left + " " + op + " " + right + ")", nil
+// typeOf returns the inferred type of a Tengo expression.
+func (t *Transpiler) typeOf(expr ast.Expr) Type {
+	return t.types[expr]
+}
 
-	case *ast.IntLit:
-		return node.Literal, nil // as number
+// convertStmt converts a Tengo statement into Lua statements. The hooks of
+// the options are applied before the default conversion.
+func (t *Transpiler) convertStmt(stmt ast.Stmt) (luaBlock, error) {
+	// expressions of the enclosing statement cannot be hoisted into the
+	// statements nested in it
+	prevHoist := t.hoist
+	t.hoist = nil
+	defer func() { t.hoist = prevHoist }()
 
-	case *ast.FloatLit:
-		return node.Literal, nil // as number
+	code, err := t.applyHooks(stmt, 0)
+	if err != nil {
+		return nil, err
+	}
+	if code.IsExpr() {
+		return nil, t.error(stmt, "hook returned an expression for a statement")
+	}
+	out := code.stmts
 
-	case *ast.BoolLit:
-		if node.Value {
-			return "true", nil
-		} else {
-			return "false", nil
+	// the generated statements are mapped back to the Tengo statement
+	for _, s := range out {
+		if s.position() == source.NoPos {
+			s.setPosition(stmt.Pos())
 		}
+	}
 
-	case *ast.StringLit:
-		return strconv.Quote(node.Value), nil
-
-	case *ast.CharLit:
-		// TODO: character literal not supported
-		return "", t.error(node, "character literal not supported")
+	return out, nil
+}
 
-	case *ast.UndefinedLit:
-		return "nil", nil
+// lowerStmt is the default conversion of a Tengo statement.
+func (t *Transpiler) lowerStmt(stmt ast.Stmt) (luaBlock, error) {
+	switch node := stmt.(type) {
+	case *ast.BlockStmt:
+		return t.convertStmts(node.Stmts, true)
 
-	case *ast.UnaryExpr:
-		expr, err := t.convert(node.Expr)
+	case *ast.ExprStmt:
+		pre, expr, err := t.convertHoisted(node.Expr)
 		if err != nil {
-			return "", err
+			return nil, err
 		}
 
-		switch node.Token {
-		case token.Not:
-			return "(not (" + expr + "))", nil
-		case token.Sub:
-			return "(-(" + expr + "))", nil
-		case token.Xor:
-			return "", t.error(node, "binary complement not supported")
-		case token.Add:
-			return "(+(" + expr + "))", nil // TODO: is this even valid?
-		default:
-			return "", t.error(node, "invalid unary operator: %s", node.Token.String())
+		// Lua only accepts function calls and assignments as statements.
+		// Other expressions (and calls starting with "(", which Lua could
+		// parse as a continuation of the previous statement) are evaluated
+		// into a discarded local variable:
+		//
+		// do local _ = (expr) end
+		if call, isCall := expr.(*luaCall); isCall && !startsWithParen(call) {
+			return append(pre, &luaCallStmt{call: call}), nil
 		}
 
-	case *ast.ReturnStmt:
-		if node.Result == nil {
-			return t.line("return"), nil
-		} else {
-			expr, err := t.convert(node.Result)
-			if err != nil {
-				return "", err
-			}
-
-			return t.line("return (%s)", expr), nil
-		}
+		return append(pre, &luaDo{body: luaBlock{
+			&luaLocal{names: []string{"_"}, values: []luaExpr{expr}},
+		}}), nil
 
-	case *ast.SelectorExpr:
-		expr, err := t.convert(node.Expr)
+	case *ast.IncDecStmt:
+		// expand to "expr = expr + 1"
+		pre, expr, err := t.convertTarget(node.Expr)
 		if err != nil {
-			return "", err
+			return nil, err
 		}
-		index, err := t.convert(node.Sel)
-		if err != nil {
-			return "", err
+		if ident, ok := node.Expr.(*ast.Ident); ok {
+			if _, _, exists := t.symbolTable.Resolve(ident.Name); !exists && t.isInput(ident.Name) {
+				if _, err := t.useInput(ident.Name, ident.Pos(), true); err != nil {
+					return nil, err
+				}
+			}
 		}
-		return "(" + expr + ")[" + index + "]", nil
 
-	case *ast.IndexExpr:
-		expr, err := t.convert(node.Expr)
-		if err != nil {
-			return "", err
+		op := "+"
+		if node.Token == token.Dec {
+			op = "-"
 		}
-		index, err := t.convert(node.Index)
-		if err != nil {
-			return "", err
+
+		return append(pre, &luaAssign{
+			targets: []luaExpr{expr},
+			values:  []luaExpr{&luaBinary{op: op, left: expr, right: &luaLiteral{text: "1"}}},
+		}), nil
+
+	case *ast.AssignStmt:
+		return t.convertAssignment(node, node.LHS, node.RHS, node.Token)
+
+	case *ast.ReturnStmt:
+		if node.Result == nil {
+			return luaBlock{&luaReturn{}}, nil
 		}
-		return "(" + expr + ")[" + index + "]", nil
 
-	case *ast.Ident:
-		_, _, ok := t.symbolTable.Resolve(node.Name)
-		if !ok {
-			// check builtin function name
-			if _, ok := builtinFunctions[node.Name]; ok {
-				t.builtinFuncsUsed[node.Name] = true
-				return node.Name, nil
-			}
+		pre, expr, err := t.convertHoisted(node.Result)
+		if err != nil {
+			return nil, err
+		}
 
-			return "", t.error(node, "unresolved reference '%s'", node.Name)
+		// parentheses truncate the results of a Lua function call to a
+		// single value
+		if call, isCall := expr.(*luaCall); isCall {
+			expr = &luaParen{expr: call}
 		}
 
-		return node.Name, nil
+		return append(pre, &luaReturn{values: []luaExpr{expr}}), nil
 
 	case *ast.IfStmt:
 		// open new symbol table for the statement
@@ -290,49 +344,46 @@ func (t *Transpiler) convert(node ast.Node) (string, error) {
 		//   end
 		// end
 
-		out := t.line("do")
-		t.indentLevel++
+		var out luaBlock
 
 		if node.Init != nil {
-			init, err := t.convert(node.Init)
+			init, err := t.convertStmt(node.Init)
 			if err != nil {
-				return "", err
+				return nil, err
 			}
-			out += t.line(init)
+			out = append(out, init...)
 		}
 
-		cond, err := t.convert(node.Cond)
+		// "if true { ... }" is left by constant folding
+		if lit, ok := node.Cond.(*ast.BoolLit); ok && lit.Value && node.Else == nil {
+			body, err := t.convertStmt(node.Body)
+			if err != nil {
+				return nil, err
+			}
+			return luaBlock{&luaDo{body: append(out, body...)}}, nil
+		}
+
+		pre, cond, err := t.convertHoisted(node.Cond)
 		if err != nil {
-			return "", err
+			return nil, err
 		}
-		out += t.line("if (%s) then", cond)
-		t.indentLevel++
+		out = append(out, pre...)
 
-		body, err := t.convert(node.Body)
+		body, err := t.convertStmt(node.Body)
 		if err != nil {
-			return "", err
+			return nil, err
 		}
-		out += body
-		t.indentLevel--
+		ifStmt := &luaIf{cond: cond, body: body}
 
 		if node.Else != nil {
-			out += t.line("else")
-			t.indentLevel++
-
-			elseBody, err := t.convert(node.Else)
+			ifStmt.els, err = t.convertStmt(node.Else)
 			if err != nil {
-				return "", err
+				return nil, err
 			}
-			out += elseBody
-			t.indentLevel--
 		}
+		out = append(out, ifStmt)
 
-		out += t.line("end")
-
-		t.indentLevel--
-		out += t.line("end")
-
-		return out, nil
+		return luaBlock{&luaDo{body: out}}, nil
 
 	case *ast.ForStmt:
 		// open new symbol table for the statement
@@ -344,108 +395,63 @@ func (t *Transpiler) convert(node ast.Node) (string, error) {
 		t.loopDepth++
 		defer func() { t.loopDepth-- }()
 
+		// counting loops are converted into numeric "for" loops
+		if loop, ok := analyzeNumericFor(node, t.funcAssigned); ok {
+			return t.convertNumericFor(loop, node.Body)
+		}
+
 		// do
 		//   (init statement)
 		//   while (condition expression) do
-		//     local __cont__ = false
-		//     repeat
-		//       (body)
-		//       __cont__ = true
-		//	   until 1
-		//     if __cont__ then
-		//       (post statement)
-		//     else
-		//     	 break
-		//     end
+		//     (body and post statement)
 		//   end
 		// end
-		//
-		//  inside (body)
-		//    - Tengo "break" will simply break from the inner loop
-		//    - Tengo "continue " will set '__cont__' to true, then break from the inner loop
 
-		var out string
+		var out luaBlock
 
 		// init
 		if node.Init != nil {
-			out += t.line("do")
-			t.indentLevel++
-
-			init, err := t.convert(node.Init)
+			init, err := t.convertStmt(node.Init)
 			if err != nil {
-				return "", err
+				return nil, err
 			}
-
-			out += init
+			out = append(out, init...)
 		}
 
 		// while (cond) do
-		if node.Cond != nil {
-			cond, err := t.convert(node.Cond)
+		loop := &luaWhile{cond: luaTrue}
+		if node.Cond != nil && needsHoisting(node.Cond) {
+			// the condition is evaluated in every iteration:
+			//
+			// while true do
+			//   (hoisted statements)
+			//   if not (cond) then break end
+			pre, cond, err := t.convertHoisted(node.Cond)
 			if err != nil {
-				return "", err
+				return nil, err
 			}
-			out += t.line("while (%s) do", cond)
-		} else {
-			out += t.line("while true do")
-		}
-		t.indentLevel++
-
-		// local __cont__ = false
-		var contVarName = t.continueVarName()
-		out += t.line("local %s = false", contVarName)
-
-		// repeat
-		out += t.line("repeat")
-		t.indentLevel++
-
-		// (body)
-		body, err := t.convert(node.Body)
-		if err != nil {
-			return "", err
-		}
-		out += body
-
-		// __cont__ = true
-		out += t.line("%s = true", contVarName)
-
-		// until 1
-		t.indentLevel--
-		out += t.line("until 1")
-
-		// if __cont__ then
-		out += t.line("if %s then", contVarName)
-		t.indentLevel++
-
-		// (post)
-		if node.Post != nil {
-			post, err := t.convert(node.Post)
+			loop.body = append(pre, &luaIf{
+				cond: &luaUnary{op: "not", expr: cond},
+				body: luaBlock{&luaBreak{}},
+			})
+		} else if node.Cond != nil {
+			cond, err := t.convertExpr(node.Cond)
 			if err != nil {
-				return "", err
+				return nil, err
 			}
-			out += post
+			loop.cond = cond
 		}
 
-		// else
-		t.indentLevel--
-		out += t.line("else")
-		t.indentLevel++
-
-		// break
-		out += t.line("break")
-
-		// end
-		t.indentLevel--
-		out += t.line("end")
-
-		// end
-		t.indentLevel--
-		out += t.line("end")
+		// (body and post statement)
+		body, err := t.convertLoopBody(node.Body, node.Post)
+		if err != nil {
+			return nil, err
+		}
+		loop.body = append(loop.body, body...)
+		out = append(out, loop)
 
 		if node.Init != nil {
-			// end
-			t.indentLevel--
-			out += t.line("end")
+			return luaBlock{&luaDo{body: out}}, nil
 		}
 
 		return out, nil
@@ -461,152 +467,304 @@ func (t *Transpiler) convert(node ast.Node) (string, error) {
 		defer func() { t.loopDepth-- }()
 
 		// for (key), (value) in __iter__(seq) do
-		//   local __cont__ = false
-		//   repeat
-		//     (body)
-		//     __cont__ = true
-		//	 until 1
-		//   if not __cont__ then break end
+		//   (body)
 		// end
-		//
-		//  inside (body)
-		//    - Tengo "break" will simply break from the inner loop
-		//    - Tengo "continue " will set '__cont__' to true, then break from the inner loop
 
-		// for (key), (value) in pairs(seq) do
-		keyVarName := node.Key.Name
-		if keyVarName != "_" {
-			t.symbolTable.Define(keyVarName)
+		var vars []string
+		for _, ident := range []*ast.Ident{node.Key, node.Value} {
+			if ident.Name != "_" {
+				if err := t.defineVar(ident); err != nil {
+					return nil, err
+				}
+			}
+			vars = append(vars, LuaName(ident.Name))
 		}
-		valueVarName := node.Value.Name
-		if valueVarName != "_" {
-			t.symbolTable.Define(valueVarName)
+		pre, iterable, err := t.convertHoisted(node.Iterable)
+		if err != nil {
+			return nil, err
 		}
-		iterable, err := t.convert(node.Iterable)
+
+		// (body)
+		body, err := t.convertLoopBody(node.Body, nil)
 		if err != nil {
-			return "", err
+			return nil, err
 		}
-		out := t.line("for %s, %s in __iter__(%s) do", keyVarName, valueVarName, iterable)
-		t.indentLevel++
 
-		// local __cont__ = false
-		var contVarName = t.continueVarName()
-		out += t.line("local %s = false", contVarName)
+		// maps are iterated directly
+		iterator := luaCallName("pairs", iterable)
+		if t.typeOf(node.Iterable) != TypeMap {
+			iterator = t.helperCall(helperIterator, iterable)
+		}
 
-		// repeat
-		out += t.line("repeat")
-		t.indentLevel++
+		return append(pre, &luaGenericFor{
+			names: vars,
+			exprs: []luaExpr{iterator},
+			body:  body,
+		}), nil
 
-		// (body)
-		body, err := t.convert(node.Body)
-		if err != nil {
-			return "", err
+	case *ast.BranchStmt:
+		if node.Token == token.Break {
+			return luaBlock{&luaBreak{}}, nil
+		} else if node.Token == token.Continue {
+			if t.options.Target.hasGoto() {
+				return luaBlock{&luaGoto{label: t.continueLabel()}}, nil
+			}
+			return luaBlock{
+				&luaAssign{targets: []luaExpr{&luaName{name: t.continueVarName()}}, values: []luaExpr{luaTrue}},
+				&luaBreak{},
+			}, nil
+		} else {
+			panic(fmt.Errorf("invalid branch statement: %s", node.Token.String()))
 		}
-		out += body
 
-		// __cont__ = true
-		out += t.line("%s = true", contVarName)
+	case *ast.ExportStmt:
+		return nil, t.error(node, "export statement not supported")
+	}
 
-		// until 1
-		t.indentLevel--
-		out += t.line("until 1")
+	return nil, nil
+}
 
-		// if not __cont__ then break end
-		out += t.line("if not %s then break end", contVarName)
+// convertExpr converts a Tengo expression into a Lua expression. The hooks
+// of the options are applied before the default conversion.
+func (t *Transpiler) convertExpr(expr ast.Expr) (luaExpr, error) {
+	code, err := t.applyHooks(expr, 0)
+	if err != nil {
+		return nil, err
+	}
+	if !code.IsExpr() {
+		return nil, t.error(expr, "hook returned statements for an expression")
+	}
 
-		// end
-		t.indentLevel--
-		out += t.line("end")
+	return code.expr, nil
+}
 
-		t.helpersUsed[helperIterator] = true
+// lowerExpr is the default conversion of a Tengo expression.
+func (t *Transpiler) lowerExpr(expr ast.Expr) (luaExpr, error) {
+	switch node := expr.(type) {
+	case *ast.ParenExpr:
+		// parentheses are added where Lua operator precedence requires them
+		return t.convertExpr(node.Expr)
 
-		return out, nil
+	case *ast.BinaryExpr:
+		if (node.Token == token.LAnd || node.Token == token.LOr) && needsHoisting(node.RHS) && t.canHoist(node) {
+			return t.hoistLogicalExpr(node)
+		}
 
-	case *ast.BranchStmt:
-		if node.Token == token.Break {
-			return t.line("break"), nil
-		} else if node.Token == token.Continue {
-			return t.line(t.continueVarName()+" = true") + t.line("break"), nil
+		if node.Token != token.LAnd && node.Token != token.LOr {
+			operands, err := t.convertOperands(node.LHS, node.RHS)
+			if err != nil {
+				return nil, err
+			}
+			return t.binaryOp(node, node.Token, operands[0], operands[1], t.typeOf(node.LHS), t.typeOf(node.RHS))
+		}
+
+		left, err := t.convertExpr(node.LHS)
+		if err != nil {
+			return nil, err
+		}
+
+		// the right-hand side of '&&' and '||' is not always evaluated
+		right, err := t.convertConditional(node.RHS)
+		if err != nil {
+			return nil, err
+		}
+
+		return t.binaryOp(node, node.Token, left, right, t.typeOf(node.LHS), t.typeOf(node.RHS))
+
+	case *ast.IntLit:
+		out, err := luaInt(node.Literal, t.options.Target)
+		if err != nil {
+			return nil, t.error(node, "%s", err.Error())
+		}
+		return &luaLiteral{text: out}, nil
+
+	case *ast.FloatLit:
+		out, err := luaFloat(node.Literal)
+		if err != nil {
+			return nil, t.error(node, "%s", err.Error())
+		}
+		return &luaLiteral{text: out}, nil
+
+	case *ast.BoolLit:
+		if node.Value {
+			return luaTrue, nil
 		} else {
-			panic(fmt.Errorf("invalid branch statement: %s", node.Token.String()))
+			return luaFalse, nil
+		}
+
+	case *ast.StringLit:
+		return &luaStringLit{value: node.Value}, nil
+
+	case *ast.CharLit:
+		// TODO: character literal not supported
+		return nil, t.error(node, "character literal not supported")
+
+	case *ast.UndefinedLit:
+		return luaNil, nil
+
+	case *ast.UnaryExpr:
+		expr, err := t.convertExpr(node.Expr)
+		if err != nil {
+			return nil, err
 		}
 
+		switch node.Token {
+		case token.Not:
+			return &luaUnary{op: "not", expr: expr}, nil
+		case token.Sub:
+			return &luaUnary{op: "-", expr: expr}, nil
+		case token.Xor:
+			if t.options.Target.hasIntegers() {
+				return &luaUnary{op: "~", expr: expr}, nil
+			}
+			if lib := t.options.Target.bitLibrary(); lib != "" {
+				return &luaCall{fn: luaNameIndex(lib, "bnot"), args: []luaExpr{expr}}, nil
+			}
+			return nil, t.error(node, "binary complement not supported by %s", t.options.Target)
+		case token.Add:
+			// Lua has no unary plus operator
+			return expr, nil
+		default:
+			return nil, t.error(node, "invalid unary operator: %s", node.Token.String())
+		}
+
+	case *ast.SelectorExpr:
+		obj, err := t.convertExpr(node.Expr)
+		if err != nil {
+			return nil, err
+		}
+		key, err := t.convertExpr(node.Sel)
+		if err != nil {
+			return nil, err
+		}
+		return &luaIndex{obj: obj, key: key}, nil
+
+	case *ast.IndexExpr:
+		operands, err := t.convertOperands(node.Expr, node.Index)
+		if err != nil {
+			return nil, err
+		}
+		return &luaIndex{obj: operands[0], key: operands[1]}, nil
+
+	case *ast.Ident:
+		_, _, ok := t.symbolTable.Resolve(node.Name)
+		if !ok {
+			// check builtin function name
+			if t.isBuiltin(node.Name) {
+				t.builtinFuncsUsed[node.Name] = true
+				return &luaName{name: t.runtimeName(node.Name)}, nil
+			}
+
+			// check host constant name
+			if api := t.options.HostAPI; api != nil {
+				if c, ok := api.Consts[node.Name]; ok {
+					lit := t.constLiteral(node, c.object())
+					if lit == ast.Expr(node) {
+						return nil, t.error(node, "host constant '%s' cannot be represented in %s", node.Name, t.options.Target)
+					}
+					return t.convertExpr(lit)
+				}
+			}
+
+			// check host global name
+			if path, ok := t.hostGlobals[node.Name]; ok {
+				// the Lua global must not be shadowed by a variable
+				if _, _, shadowed := t.symbolTable.Resolve(path[0]); shadowed && !needsMangling(path[0]) {
+					return nil, t.error(node, "host global '%s' is shadowed by variable '%s'", node.Name, path[0])
+				}
+				return hostGlobalExpr(path), nil
+			}
+
+			if t.isInput(node.Name) {
+				return t.useInput(node.Name, node.Pos(), false)
+			}
+
+			return nil, t.error(node, "unresolved reference '%s'", node.Name)
+		}
+
+		return &luaName{name: LuaName(node.Name)}, nil
+
 	case *ast.ArrayLit:
 		// Index1 == false
 		//   { [0]=nil, arr=true }
 		//   { [0]=elem1, elem2, elem3, arr=true }
 
+		arrayMark := luaField{key: &luaStringLit{value: "__a"}, value: luaTrue}
+
 		if len(node.Elements) == 0 {
-			return "{[0]=nil, __a=true}", nil
+			return &luaTable{fields: []luaField{{key: &luaLiteral{text: "0"}, value: luaNil}, arrayMark}}, nil
 		}
 
-		var out []string
-		for _, elem := range node.Elements {
-			expr, err := t.convert(elem)
-			if err != nil {
-				return "", err
+		elems, err := t.convertOperands(node.Elements...)
+		if err != nil {
+			return nil, err
+		}
+
+		var fields []luaField
+		for idx, expr := range elems {
+			field := luaField{value: expr}
+			if idx == 0 {
+				field.key = &luaLiteral{text: "0"}
 			}
-			out = append(out, "("+expr+")")
+			fields = append(fields, field)
 		}
-		return "{[0]=" + strings.Join(out, ",") + ", __a=true}", nil
+		return &luaTable{fields: append(fields, arrayMark)}, nil
 
 	case *ast.MapLit:
 		// { ["key1"] = value1, ["key2"] = value2 }
 
-		var out []string
+		var values []ast.Expr
 		for _, elt := range node.Elements {
-			val, err := t.convert(elt.Value)
-			if err != nil {
-				return "", err
-			}
+			values = append(values, elt.Value)
+		}
+		vals, err := t.convertOperands(values...)
+		if err != nil {
+			return nil, err
+		}
 
-			out = append(out, "["+strconv.Quote(elt.Key)+"]=("+val+")")
+		var fields []luaField
+		for idx, elt := range node.Elements {
+			fields = append(fields, luaField{key: &luaStringLit{value: elt.Key}, value: vals[idx]})
 		}
 
-		return "{" + strings.Join(out, ",") + "}", nil
+		return &luaTable{fields: fields}, nil
 
 	case *ast.SliceExpr:
 		// {unpack(expr, low, high-1)}
 
-		expr, err := t.convert(node.Expr)
+		operands, err := t.convertOperands(node.Expr, node.Low, node.High)
 		if err != nil {
-			return "", err
+			return nil, err
 		}
 
-		low, err := t.convert(node.Low)
-		if err != nil {
-			return "", err
-		}
+		return t.helperCall(helperSlicing, operands...), nil
 
-		high, err := t.convert(node.High)
-		if err != nil {
-			return "", err
+	case *ast.CallExpr:
+		if err := t.checkHostCall(node); err != nil {
+			return nil, err
 		}
 
-		t.helpersUsed[helperSlicing] = true
-
-		return "__slice__(" + expr + "," + low + "," + high + ")", nil
-
-	case *ast.CallExpr:
-		ident, err := t.convert(node.Func)
-		if err != nil {
-			return "", err
+		if tmpl := t.callRule(node.Func); tmpl != nil {
+			return t.convertRuleCall(node, tmpl)
 		}
 
-		var args []string
-		for _, a := range node.Args {
-			arg, err := t.convert(a)
-			if err != nil {
-				return "", err
+		// the length of a string is its length in bytes in both languages
+		if ident, ok := node.Func.(*ast.Ident); ok && ident.Name == "len" && !t.prelude["len"].custom && len(node.Args) == 1 && t.typeOf(node.Args[0]) == TypeString {
+			if _, _, defined := t.symbolTable.Resolve(ident.Name); !defined {
+				arg, err := t.convertExpr(node.Args[0])
+				if err != nil {
+					return nil, err
+				}
+				return &luaUnary{op: "#", expr: arg}, nil
 			}
-			args = append(args, arg)
 		}
 
-		//if fn, ok := ConvertFunctions[ident]; ok {
-		//	return fn(args)
-		//}
+		operands, err := t.convertOperands(append([]ast.Expr{node.Func}, node.Args...)...)
+		if err != nil {
+			return nil, err
+		}
 
-		return ident + "(" + strings.Join(args, ",") + ")", nil
+		return &luaCall{fn: operands[0], args: operands[1:]}, nil
 
 	case *ast.FuncLit:
 		t.symbolTable = t.symbolTable.Fork(false)
@@ -618,76 +776,70 @@ func (t *Transpiler) convert(node ast.Node) (string, error) {
 
 		var params []string
 		for _, p := range node.Type.Params.List {
-			t.symbolTable.Define(p.Name)
-
-			param, err := t.convert(p)
-			if err != nil {
-				return "", err
+			if err := t.defineVar(p); err != nil {
+				return nil, err
 			}
-			params = append(params, param)
+			params = append(params, LuaName(p.Name))
 		}
 
-		out := t.line("function(%s)", strings.Join(params, ","))
-
-		t.indentLevel++
-
-		body, err := t.convert(node.Body)
+		body, err := t.convertStmt(node.Body)
 		if err != nil {
-			return "", err
+			return nil, err
 		}
-		out += body
 
-		t.indentLevel--
-		out += t.line("end")
-
-		return out, nil
+		return &luaFunction{params: params, body: body}, nil
 
 	case *ast.ImportExpr:
-		return "", t.error(node, "import expression not supported")
-
-	case *ast.ExportStmt:
-		return "", t.error(node, "export statement not supported")
+		return nil, t.error(node, "import expression not supported")
 
 	case *ast.ErrorExpr:
-		return "", t.error(node, "error expression not supported")
+		return nil, t.error(node, "error expression not supported")
 
 	case *ast.ImmutableExpr:
 		// TODO: use metamethods (http://lua-users.org/wiki/ReadOnlyTables)
-		return "", t.error(node, "immutable expression not supported")
+		return nil, t.error(node, "immutable expression not supported")
 
 	case *ast.CondExpr:
-		// (function() if (cond) then return (true-expr) else return (false-expr) end end)()
+		return t.convertCondExpr(node)
+	}
 
-		cond, err := t.convert(node.Cond)
-		if err != nil {
-			return "", err
+	return nil, t.error(expr, "expression not supported")
+}
+
+// convertStmts converts a list of statements that form a single Lua block.
+// Lua only allows "return" and "break" as the last statement of a block, so
+// any jump that is followed by other statements (or that is not at the end of
+// the enclosing Lua block, when 'terminal' is false) is wrapped in "do ... end".
+func (t *Transpiler) convertStmts(stmts []ast.Stmt, terminal bool) (luaBlock, error) {
+	last := -1
+	for idx, stmt := range stmts {
+		if _, ok := stmt.(*ast.EmptyStmt); !ok {
+			last = idx
 		}
+	}
 
-		trueExpr, err := t.convert(node.True)
+	var out luaBlock
+	for idx, stmt := range stmts {
+		converted, err := t.convertStmt(stmt)
 		if err != nil {
-			return "", err
+			return nil, err
 		}
 
-		falseExpr, err := t.convert(node.False)
-		if err != nil {
-			return "", err
+		if isJumpStmt(stmt) && (idx != last || !terminal) {
+			out = append(out, &luaDo{luaStmtPos: luaStmtPos{pos: stmt.Pos()}, body: converted})
+			continue
 		}
 
-		return "(function() if (" + cond + ") then return (" + trueExpr + ") else return (" + falseExpr + ") end end)()", nil
+		out = append(out, converted...)
 	}
 
-	return "", nil
+	return out, nil
 }
 
-func (t *Transpiler) line(format string, args ...interface{}) string {
-	return strings.Repeat(t.options.Indent, t.indentLevel) +
-		fmt.Sprintf(format, args...) + "\n"
-}
-
-func (t *Transpiler) convertAssignment(node ast.Node, lhs, rhs []ast.Expr, op token.Token) (string, error) {
+func (t *Transpiler) convertAssignment(node ast.Node, lhs, rhs []ast.Expr, op token.Token) (luaBlock, error) {
 	numLHS, numRHS := len(lhs), len(rhs)
 	if numLHS > 1 || numRHS > 1 {
-		return "", t.error(node, "tuple assignment not allowed")
+		return nil, t.error(node, "tuple assignment not allowed")
 	}
 
 	// resolve and compile left-hand side
@@ -696,70 +848,288 @@ func (t *Transpiler) convertAssignment(node ast.Node, lhs, rhs []ast.Expr, op to
 
 	if op == token.Define && numSel > 0 {
 		// using selector on new variable does not make sense
-		return "", t.error(node, "operator ':=' not allowed with selector")
+		return nil, t.error(node, "operator ':=' not allowed with selector")
 	}
 
 	symbol, depth, exists := t.symbolTable.Resolve(ident)
 	if op == token.Define {
 		if depth == 0 && exists {
-			return "", t.error(node, "'%s' redeclared in this block", ident)
+			return nil, t.error(node, "'%s' redeclared in this block", ident)
 		}
 
 		if reservedVarName.MatchString(ident) {
-			return "", t.error(node, "cannot use variable name '%s'", ident)
+			return nil, t.error(node, "cannot use variable name '%s'", ident)
 		}
 
 		symbol = t.symbolTable.Define(ident)
-	} else {
-		if !exists {
-			return "", t.error(node, "unresolved reference '%s'", ident)
-		}
+	} else if !exists && !t.isInput(ident) {
+		return nil, t.error(node, "unresolved reference '%s'", ident)
 	}
+	isInput := !exists && op != token.Define
 
 	// left-hand side
-	left, err := t.convert(lhs[0])
+	var pre luaBlock
+	var left luaExpr
+	var err error
+	if isInput && numSel == 0 {
+		// the previous value is read by compound assignments only
+		left, err = t.useInput(ident, lhs[0].Pos(), true)
+		if err == nil && op != token.Assign {
+			_, err = t.useInput(ident, lhs[0].Pos(), false)
+		}
+	} else if op == token.Define || op == token.Assign {
+		left, err = t.convertExpr(lhs[0])
+	} else {
+		// the target of a compound assignment is evaluated only once
+		pre, left, err = t.convertTarget(lhs[0])
+	}
 	if err != nil {
-		return "", err
+		return nil, err
 	}
 
 	// right-hand side
-	right, err := t.convert(rhs[0])
+	rightPre, right, err := t.convertHoisted(rhs[0])
 	if err != nil {
-		return "", err
+		return nil, err
 	}
+	pre = append(pre, rightPre...)
 
 	switch op {
 	case token.Define:
-		pref := ""
 		if !t.options.EnableGlobalScope || symbol.Scope != compiler.ScopeGlobal {
-			pref = "local "
+			name := LuaName(ident)
+			if refersTo(rhs[0], ident) {
+				// the new variable is visible in its own initializer (for
+				// recursive functions), but a Lua local is not
+				block := luaBlock{&luaLocal{names: []string{name}}}
+				block = append(block, pre...)
+				return append(block, &luaAssign{targets: []luaExpr{left}, values: []luaExpr{right}}), nil
+			}
+			return append(pre, &luaLocal{names: []string{name}, values: []luaExpr{right}}), nil
 		}
-		return pref + left + "=" + right, nil
+		return append(pre, &luaAssign{targets: []luaExpr{left}, values: []luaExpr{right}}), nil
 	case token.Assign:
-		return left + "=" + right, nil
-	case token.AddAssign:
-		t.helpersUsed[helperStringConcat] = true
-		return left + "=" + left + "+" + right, nil
-	case token.SubAssign:
-		return left + "=" + left + "-" + right, nil
-	case token.MulAssign:
-		return left + "=" + left + "*" + right, nil
-	case token.QuoAssign:
-		return left + "=" + left + "/" + right, nil
-	case token.RemAssign:
-		return left + "=" + left + "%" + right, nil
-	case token.AndAssign, token.OrAssign, token.AndNotAssign, token.XorAssign, token.ShlAssign, token.ShrAssign:
-		// TODO: bitwise operators
-		return "", t.error(node, "compound assignment "+op.String()+" not supported")
+		return append(pre, &luaAssign{targets: []luaExpr{left}, values: []luaExpr{right}}), nil
+	}
+
+	binOp, ok := compoundAssignOps[op]
+	if !ok {
+		return nil, t.error(node, "assignment operator "+op.String()+" not supported")
+	}
+
+	expr, err := t.binaryOp(node, binOp, left, right, t.typeOf(lhs[0]), t.typeOf(rhs[0]))
+	if err != nil {
+		return nil, err
+	}
+
+	return append(pre, &luaAssign{targets: []luaExpr{left}, values: []luaExpr{expr}}), nil
+}
+
+// compoundAssignOps maps compound assignment operators to their binary
+// operators.
+var compoundAssignOps = map[token.Token]token.Token{
+	token.AddAssign:    token.Add,
+	token.SubAssign:    token.Sub,
+	token.MulAssign:    token.Mul,
+	token.QuoAssign:    token.Quo,
+	token.RemAssign:    token.Rem,
+	token.AndAssign:    token.And,
+	token.OrAssign:     token.Or,
+	token.XorAssign:    token.Xor,
+	token.AndNotAssign: token.AndNot,
+	token.ShlAssign:    token.Shl,
+	token.ShrAssign:    token.Shr,
+}
+
+// binaryOp lowers a binary operation. The types of the operands are used to
+// pick direct Lua operations where possible.
+func (t *Transpiler) binaryOp(node ast.Node, op token.Token, left, right luaExpr, leftType, rightType Type) (luaExpr, error) {
+	target := t.options.Target
+
+	var luaOp string
+	switch op {
+	case token.LAnd:
+		luaOp = "and"
+	case token.LOr:
+		luaOp = "or"
+	case token.NotEqual:
+		luaOp = "~="
+	case token.Add:
+		luaOp = "+"
+		if leftType == TypeString && (rightType == TypeString || rightType.isNumber()) {
+			luaOp = ".."
+		} else if !leftType.isNumber() || !rightType.isNumber() {
+			// potentially string + operator was used
+			return t.helperCall(helperStringConcat, left, right), nil
+		}
+	case token.Quo:
+		if target.hasIntegers() && (leftType != TypeFloat && rightType != TypeFloat) {
+			// integer division truncates toward zero in Tengo
+			return t.helperCall(helperDivision, left, right), nil
+		}
+		luaOp = "/"
+	case token.And, token.Or, token.Xor, token.AndNot, token.Shl, token.Shr:
+		return t.bitwiseOp(node, op, left, right)
+	default:
+		luaOp = op.String()
+	}
+
+	return &luaBinary{op: luaOp, left: left, right: right}, nil
+}
+
+// bitwiseOp converts a bitwise operation. Lua 5.3+ has native bitwise
+// operators, Lua 5.2 and LuaJIT have a library for them ('bit32' and 'bit').
+func (t *Transpiler) bitwiseOp(node ast.Node, op token.Token, left, right luaExpr) (luaExpr, error) {
+	target := t.options.Target
+
+	if target.hasIntegers() {
+		switch op {
+		case token.And:
+			return &luaBinary{op: "&", left: left, right: right}, nil
+		case token.Or:
+			return &luaBinary{op: "|", left: left, right: right}, nil
+		case token.Xor:
+			return &luaBinary{op: "~", left: left, right: right}, nil
+		case token.AndNot:
+			return &luaBinary{op: "&", left: left, right: &luaUnary{op: "~", expr: right}}, nil
+		case token.Shl:
+			return &luaBinary{op: "<<", left: left, right: right}, nil
+		case token.Shr:
+			// '>>' is a logical shift in Lua but an arithmetic shift in Tengo
+			return t.helperCall(helperShiftRight, left, right), nil
+		}
+	}
+
+	lib := target.bitLibrary()
+	if lib == "" {
+		return nil, t.error(node, "operator %s not supported by %s", op.String(), target)
+	}
+
+	libCall := func(name string, args ...luaExpr) luaExpr {
+		return &luaCall{fn: luaNameIndex(lib, name), args: args}
+	}
+
+	switch op {
+	case token.And:
+		return libCall("band", left, right), nil
+	case token.Or:
+		return libCall("bor", left, right), nil
+	case token.Xor:
+		return libCall("bxor", left, right), nil
+	case token.AndNot:
+		return libCall("band", left, libCall("bnot", right)), nil
+	case token.Shl:
+		return libCall("lshift", left, right), nil
+	default:
+		return libCall("arshift", left, right), nil
+	}
+}
+
+// defineVar defines a loop variable or a function parameter in the current
+// scope.
+func (t *Transpiler) defineVar(ident *ast.Ident) error {
+	if reservedVarName.MatchString(ident.Name) {
+		return t.error(ident, "cannot use variable name '%s'", ident.Name)
+	}
+
+	t.symbolTable.Define(ident.Name)
+
+	return nil
+}
+
+// convertLoopBody converts the body and the post statement of a loop. If the
+// body has a "continue" statement, it's lowered using "goto" on the targets
+// that support it, or, using an inner "repeat" loop on Lua 5.1.
+func (t *Transpiler) convertLoopBody(body *ast.BlockStmt, post ast.Stmt) (luaBlock, error) {
+	var out luaBlock
+
+	switch {
+	case !usesContinue(body):
+		// (body)
+		// (post statement)
+		stmts, err := t.convertStmts(body.Stmts, post == nil)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, stmts...)
+
+	case t.options.Target.hasGoto():
+		// do
+		//   (body)
+		// end
+		// ::continue_N::
+		// (post statement)
+		//
+		//  inside (body)
+		//    - Tengo "continue" will jump to 'continue_N' label
+		//    - the body is enclosed in a block so the jump never enters the
+		//      scope of a local variable
+
+		stmts, err := t.convertStmts(body.Stmts, true)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, &luaDo{body: stmts}, &luaLabel{name: t.continueLabel()})
+
 	default:
-		return "", t.error(node, "assignment operator "+op.String()+"not supported")
+		// local __cont__ = false
+		// repeat
+		//   (body)
+		//   __cont__ = true
+		// until true
+		// if not __cont__ then break end
+		// (post statement)
+		//
+		//  inside (body)
+		//    - Tengo "break" will simply break from the inner loop
+		//    - Tengo "continue " will set '__cont__' to true, then break from the inner loop
+
+		contVar := &luaName{name: t.continueVarName()}
+
+		stmts, err := t.convertStmts(body.Stmts, false)
+		if err != nil {
+			return nil, err
+		}
+		stmts = append(stmts, &luaAssign{targets: []luaExpr{contVar}, values: []luaExpr{luaTrue}})
+
+		out = append(out,
+			&luaLocal{names: []string{contVar.name}, values: []luaExpr{luaFalse}},
+			&luaRepeat{body: stmts, cond: luaTrue},
+			&luaIf{cond: &luaUnary{op: "not", expr: contVar}, body: luaBlock{&luaBreak{}}})
+	}
+
+	if post != nil {
+		stmts, err := t.convertStmt(post)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, stmts...)
 	}
+
+	return out, nil
 }
 
 func (t *Transpiler) continueVarName() string {
 	return fmt.Sprintf("__cont_%d__", t.loopDepth)
 }
 
+func (t *Transpiler) continueLabel() string {
+	return fmt.Sprintf("continue_%d", t.loopDepth)
+}
+
+// isJumpStmt returns true if the statement is converted into a Lua "return"
+// or "break" statement.
+func isJumpStmt(stmt ast.Stmt) bool {
+	switch stmt := stmt.(type) {
+	case *ast.ReturnStmt:
+		return true
+	case *ast.BranchStmt:
+		return stmt.Token == token.Break || stmt.Token == token.Continue
+	}
+
+	return false
+}
+
 func resolveAssignLHS(expr ast.Expr) (name string, selectors []ast.Expr) {
 	switch term := expr.(type) {
 	case *ast.SelectorExpr:
@@ -779,9 +1149,13 @@ func resolveAssignLHS(expr ast.Expr) (name string, selectors []ast.Expr) {
 }
 
 func (t *Transpiler) error(node ast.Node, format string, args ...interface{}) error {
+	return t.errorAt(node.Pos(), format, args...)
+}
+
+func (t *Transpiler) errorAt(pos source.Pos, format string, args ...interface{}) error {
 	return &Error{
 		fileSet: t.file.Set(),
-		node:    node,
+		pos:     pos,
 		error:   fmt.Errorf(format, args...),
 	}
 }
@@ -1,6 +1,15 @@
 package tengo2lua_test
 
-import "testing"
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/d5/tengo/assert"
+	"github.com/d5/tengo/compiler/ast"
+	"github.com/d5/tengo2lua"
+	"github.com/yuin/gopher-lua"
+)
 
 func TestEval(t *testing.T) {
 	convertEval(t, `return 5`, 5.0)
@@ -64,6 +73,15 @@ func TestEval(t *testing.T) {
 	convertEval(t, `s:=0; for i:=1;i<=3;i++ { if i==2 { break }; for j:=1;j<=2;j++ { s+=i*j } }; return s`, 3.0)     // 1+2
 	convertEval(t, `s:=0; for i:=1;i<=3;i++ { if i==2 { continue }; for j:=1;j<=2;j++ { s+=i*j } }; return s`, 12.0) // 1+3+2+6
 
+	// jump statements followed by other statements
+	convertEval(t, `return 1; a := 2`, 1.0)
+	convertEval(t, `a:=func(){ return 1; return 2 }; return a()`, 1.0)
+	convertEval(t, `for { return 3 }`, 3.0)
+	convertEval(t, `s:=0; for i:=0;i<5;i++ { if i==3 { continue; s+=100 }; s+=i }; return s`, 7.0)
+	convertEval(t, `s:=0; for i:=0;i<5;i++ { if i==3 { break; s+=100 }; s+=i }; return s`, 3.0)
+	convertEval(t, `s:=0; for v in [1,2,3] { s+=v; continue }; return s`, 6.0)
+	convertEval(t, `s:=0; for v in [1,2,3] { s+=v; break }; return s`, 1.0)
+
 	// for-in statement
 	convertEval(t, `s:=0; a:=[2,4,6]; for i, v in a { s+=i }; return s`, 3.0)
 	convertEval(t, `s:=0; a:=[2,4,6]; for i, _ in a { s+=i }; return s`, 3.0)
@@ -99,6 +117,1025 @@ func TestEval(t *testing.T) {
 	convertEval(t, `c:=1; a:=func(x,y){return x+y}; return a(c+2,c+3)`, 7.0)
 	convertEval(t, `c:=1; a:=func(x,y){xy:=x+y; return xy}; return a(c+2,c+3)`, 7.0)
 
+	// expression statements and callees
+	convertEval(t, `a:=1; a+2; return a`, 1.0)
+	convertEval(t, `a:=1; a; "foo"; [1,2][0]; return a`, 1.0)
+	convertEval(t, `a:=1; f:=func(){ a=5 }; (f)(); return a`, 5.0)
+	convertEval(t, `a:=1; func(){ a=5 }(); return a`, 5.0)
+	convertEval(t, `a:=1; f:=func(){ a+=1 }; f(); (f)(); return a`, 3.0)
+	convertEval(t, `return func(x){ return x*2 }(4)`, 8.0)
+	convertEval(t, `m:={f:func(x){ return x+1 }}; return m.f(1)`, 2.0)
+	convertEval(t, `a:=[func(){ return "foo" }]; return a[0]()`, "foo")
+	convertEval(t, `a:=0; f:=func(){ return func(){ a=7 } }; f()(); return a`, 7.0)
+	convertEval(t, `a:="100%d"; a; return a`, "100%d")
+
 	// conditional expression
 	convertEval(t, `return 5>3?"foo":"bar"`, "foo")
 }
+
+func TestNames(t *testing.T) {
+	// Lua keywords
+	convertEval(t, `end:=1; local:=2; then:=3; return end+local+then`, 6.0)
+	convertEval(t, `repeat:=1; until:=2; nil:=3; function:=4; elseif:=5; goto:=6; return repeat+until+nil+function+elseif+goto`, 21.0)
+	convertEval(t, `f:=func(end, local){ return end-local }; return f(5,3)`, 2.0)
+	convertEval(t, `s:=0; for end, then in [4,5,6] { s+=end*then }; return s`, 17.0)
+
+	// unicode identifiers
+	convertEval(t, `café:=1; cafe:=2; return café*10+cafe`, 12.0)
+	convertEval(t, `변수:=func(값){ return 값+1 }; return 변수(1)`, 2.0)
+
+	// names used by the Lua runtime
+	opts := testOptions()
+	opts.EnableGlobalScope = true
+	convertEvalOpts(t, `pairs:=1; string:=2; s:=pairs+string; for k, v in {a:1} { s+=v }; return s+len("foo")`, opts, 7.0)
+	convertEvalOpts(t, `__n:=5; return len({a:1,b:2})+__n`, opts, 7.0)
+	convertEvalOpts(t, `_ENV:=1; return _ENV`, opts, 1.0)
+
+	// reserved names
+	convertError(t, `__iter__:=1`, "cannot use variable name '__iter__'")
+	convertError(t, `f:=func(__iter__){}`, "cannot use variable name '__iter__'")
+	convertError(t, `for __slice__ in [1] {}`, "cannot use variable name '__slice__'")
+
+	assert.Equal(t, "foo", tengo2lua.LuaName("foo"))
+	assert.Equal(t, "foo_bar", tengo2lua.LuaName("foo_bar"))
+	assert.Equal(t, "__end__", tengo2lua.LuaName("end"))
+	assert.Equal(t, "__caf_u00e9__", tengo2lua.LuaName("café"))
+	assert.Equal(t, "__x___u00e9__", tengo2lua.LuaName("x_é"))
+	assert.Equal(t, "__pairs__", tengo2lua.LuaName("pairs"))
+}
+
+func TestStringLiterals(t *testing.T) {
+	convertEval(t, `return "foo"`, "foo")
+	convertEval(t, `return ""`, "")
+	convertEval(t, `return "a\"b'c\\d"`, "a\"b'c\\d")
+	convertEval(t, `return "\a\b\f\n\r\t\v"`, "\a\b\f\n\r\t\v")
+	convertEval(t, `return "\x00\x001\x7f\x1b9"`, "\x00\x001\x7f\x1b9")
+	convertEval(t, `return "é한\u00e9\U0001F600"`, "é한\u00e9\U0001F600")
+	convertEval(t, `return "\xff\xfe1"`, "\xff\xfe1")
+	convertEval(t, `return {"a\nb": 1}`, MAP{"a\nb": 1.0})
+	convertEval(t, `a:={}; a["\xff"]=1; return a["\xff"]`, 1.0)
+
+	// long brackets
+	convertEval(t, "return `a\nb\nc\n\\d\\`", "a\nb\nc\n\\d\\")
+	convertEval(t, "return `\n\n\nx]]\n\\`", "\n\n\nx]]\n\\")
+	convertEval(t, "return `\n\n\n]=]]]`", "\n\n\n]=]]]")
+	convertEval(t, "return `\n\n\n]`", "\n\n\n]")
+	convertEval(t, "return `\n\n\n]=`", "\n\n\n]=")
+	assert.True(t, strings.Contains(convert(t, "return `x]]\n\n\n\n\n\n`"), "[=[x]]\n\n\n\n\n\n]=]"))
+	assert.True(t, strings.Contains(convert(t, "return `\n\n\n\n\n\n`"), "[[\n\n\n\n\n\n\n]]"))
+	assert.True(t, strings.Contains(convert(t, "return `a[[b\n\n\n\n\n\n`"), "[=[a[[b\n\n\n\n\n\n]=]"))
+	convertEval(t, "return `a[[b\n\n\n\n\n\n`", "a[[b\n\n\n\n\n\n")
+	assert.True(t, strings.Contains(convert(t, `return "a\\b"`), `"a\\b"`))
+}
+
+func TestNumberLiterals(t *testing.T) {
+	convertEval(t, `return 0`, 0.0)
+	convertEval(t, `return 755`, 755.0)
+	convertEval(t, `return 0755`, 493.0)
+	convertEval(t, `return 0x1F`, 31.0)
+	convertEval(t, `return 0XfF`, 255.0)
+	convertEval(t, `return 9007199254740992`, 9007199254740992.0)
+	convertEval(t, `return 1.5`, 1.5)
+	convertEval(t, `return 1.`, 1.0)
+	convertEval(t, `return .25`, 0.25)
+	convertEval(t, `return 1e6`, 1e6)
+	convertEval(t, `return 1.5e-7`, 1.5e-7)
+	convertEval(t, `return 0.1`, 0.1)
+	convertEval(t, `return 1e308`, 1e308)
+	convertEval(t, `return 4.9e-324`, 4.9e-324)
+	convertEval(t, `return 0755.5`, 755.5)
+
+	convertError(t, `return 9007199254740993`, "integer literal '9007199254740993' cannot be represented exactly in Lua")
+	convertError(t, `return 99999999999999999999`, "integer literal '99999999999999999999' out of range")
+	convertError(t, `return 1e400`, "floating-point literal '1e400' out of range")
+
+	assert.True(t, strings.Contains(convert(t, `return 1.0`), "return 1.0"))
+	assert.True(t, strings.Contains(convert(t, `return 0x10`), "return 16"))
+}
+
+func TestTargets(t *testing.T) {
+	srcs := []string{
+		`a:=1; b:=a/2; c:=a%2; return a+b*c-1`,
+		`a:=1; a/=2; a*=3; a%=2; return a`,
+		`s:=0; for i:=0;i<5;i++ { if i==3 { continue }; s+=i }; return s`,
+		`s:=0; for _, v in [1,2,3] { if v==2 { continue }; s+=v }; return s`,
+		`f:=func(x){ return x>0?"pos":"neg" }; return f(1)+f(-1)`,
+		"return `foo\nbar`",
+	}
+	targets := []tengo2lua.LuaVersion{tengo2lua.Lua51, tengo2lua.Lua52, tengo2lua.Lua53, tengo2lua.Lua54, tengo2lua.LuaJIT}
+	for _, target := range targets {
+		opts := testOptions()
+		opts.Target = target
+		for _, src := range srcs {
+			convertOpts(t, src, opts)
+		}
+	}
+
+	// bitwise operators
+	bitwise := `a:=12; b:=10; a&=b; a|=1; a^=2; a<<=3; a>>=1; a&^=1; return (a&b)|(a^b)&^(a<<1)>>2+^a`
+	opts := testOptions()
+	convertErrorOpts(t, bitwise, opts, "operator & not supported by Lua 5.1")
+	convertErrorOpts(t, `return ^5`, opts, "binary complement not supported by Lua 5.1")
+	opts.Target = tengo2lua.Lua52
+	assert.True(t, strings.Contains(convertOpts(t, bitwise, opts), "bit32.band(a,bit32.bnot(1))"))
+	opts.Target = tengo2lua.LuaJIT
+	assert.True(t, strings.Contains(convertOpts(t, bitwise, opts), "bit.arshift(a,1)"))
+	opts.Target = tengo2lua.Lua53
+	assert.True(t, strings.Contains(convertOpts(t, bitwise, opts), "a & ~1"))
+	assert.True(t, strings.Contains(convertOpts(t, bitwise, opts), "__shr__(a,1)"))
+	opts.Target = tengo2lua.Lua54
+	assert.True(t, strings.Contains(convertOpts(t, `return ^5`, opts), "return ~5"))
+
+	// integers
+	opts.Target = tengo2lua.Lua54
+	assert.True(t, strings.Contains(convertOpts(t, `return 7/2`, opts), "__div__(7,2)"))
+	assert.True(t, strings.Contains(convertOpts(t, `return 9223372036854775807`, opts), "9223372036854775807"))
+	opts.Target = tengo2lua.LuaJIT
+	assert.True(t, strings.Contains(convertOpts(t, `return 7/2`, opts), "return 7 / 2"))
+	convertErrorOpts(t, `return 9223372036854775807`, opts, "cannot be represented exactly in LuaJIT")
+
+	// global environment
+	opts = testOptions()
+	opts.EnableGlobalScope = true
+	opts.Environment = "env"
+	opts.AllowedGlobals = []string{"env"}
+	out := convertOpts(t, `a := "x"; return a + 1`, opts)
+	assert.True(t, strings.Contains(out, "setfenv(1, env)\n"), out)
+	l := lua.NewState()
+	defer l.Close()
+	assert.NoError(t, l.DoString(`env = setmetatable({}, {__index = _G})`))
+	assert.NoError(t, l.DoString(out))
+	assert.True(t, l.Get(-1) == lua.LString("x1"))
+	assert.True(t, l.GetField(l.GetGlobal("env"), "a") == lua.LString("x"))
+	assert.True(t, l.GetGlobal("a") == lua.LNil)
+	opts.Target = tengo2lua.Lua52
+	out = convertOpts(t, `a := "x"; return a + 1`, opts)
+	assert.True(t, strings.Contains(out, "local _ENV = env\n"), out)
+}
+
+func TestLoops(t *testing.T) {
+	// loops without "continue"
+	out := convert(t, `s:=0; for i:=0;i<5;i++ { s+=i }; for v in [1,2] { s+=v }; return s`)
+	assert.False(t, strings.Contains(out, "__cont"), out)
+	assert.False(t, strings.Contains(out, "repeat"), out)
+
+	// "continue" in nested loops and functions
+	convertEval(t, `s:=0; for i:=0;i<3;i++ { for j:=0;j<3;j++ { if j==1 { continue }; s+=j }; if i==1 { continue }; s+=10 }; return s`, 26.0)
+	convertEval(t, `s:=0; for i:=0;i<3;i++ { f:=func() { for j in [1,2] { if j==1 { continue }; s+=j } }; f() }; return s`, 6.0)
+	out = convert(t, `s:=0; for i:=0;i<3;i++ { f:=func() { for j in [1,2] { if j==1 { continue }; s+=j } }; f() }; return s`)
+	assert.False(t, strings.Contains(out, "__cont_1__"), out)
+	assert.True(t, strings.Contains(out, "__cont_2__"), out)
+
+	// goto
+	opts := testOptions()
+	for _, target := range []tengo2lua.LuaVersion{tengo2lua.Lua52, tengo2lua.Lua53, tengo2lua.Lua54, tengo2lua.LuaJIT} {
+		opts.Target = target
+		out = convertOpts(t, `s:=0; i:=0; for ;i<5;i++ { if i==3 { continue }; x:=i; s+=x }; return s`, opts)
+		assert.True(t, strings.Contains(out, "goto continue_1"), out)
+		assert.True(t, strings.Contains(out, "::continue_1::\n  i=i + 1"), out)
+		assert.False(t, strings.Contains(out, "__cont"), out)
+
+		out = convertOpts(t, `s:=0; for v in [1,2,3] { for w in [v] { if w==2 { continue } }; if v==2 { continue }; s+=v }; return s`, opts)
+		assert.True(t, strings.Contains(out, "goto continue_1"), out)
+		assert.True(t, strings.Contains(out, "goto continue_2"), out)
+		assert.False(t, strings.Contains(out, "__cont"), out)
+	}
+}
+
+func TestNumericFor(t *testing.T) {
+	convertEval(t, `s:=0; for i:=0;i<5;i++ { s+=i }; return s`, 10.0)
+	convertEval(t, `s:=0; for i:=0;i<=5;i++ { s+=i }; return s`, 15.0)
+	convertEval(t, `s:=0; for i:=5;i>0;i-- { s=s*10+i }; return s`, 54321.0)
+	convertEval(t, `s:=0; for i:=5;i>=0;i-=2 { s=s*10+i }; return s`, 531.0)
+	convertEval(t, `s:=0; for i:=0;i<10;i+=3 { s=s*10+i }; return s`, 369.0)
+	convertEval(t, `s:=0; n:=3; for i:=0;i<n;i++ { s+=i }; return s`, 3.0)
+	convertEval(t, `s:=0; n:=2.5; for i:=0;i<n;i++ { s+=i }; return s`, 3.0)
+	convertEval(t, `s:=0; n:=0.5; for i:=3;i>n;i-- { s+=i }; return s`, 6.0)
+	convertEval(t, `s:=0; n:=2.5; for i:=0.5;i<=n;i++ { s+=i }; return s`, 4.5)
+	convertEval(t, `s:=0; for i:=0;i<5;i++ { if i==1 { continue }; if i==3 { break }; s+=i }; return s`, 2.0)
+	convertEval(t, `s:=0; for i:=0;i<3;i++ { for j:=0;j<i;j++ { s+=j } }; return s`, 1.0)
+
+	for _, src := range []string{
+		`s:=0; for i:=0;i<5;i++ { s+=i }; return s`,
+		`s:=0; n:=5; for i:=0;i<n*2+1;i++ { s+=i }; return s`,
+		`s:=0; for i:=10;i>-5;i-=5 { s+=i }; return s`,
+	} {
+		out := convert(t, src)
+		assert.False(t, strings.Contains(out, "while"), out)
+	}
+
+	// loops that cannot be converted
+	for _, src := range []struct {
+		src      string
+		expected interface{}
+	}{
+		{`s:=0; for i:=0;i<5;i++ { s+=i; i++ }; return s`, 6.0},                          // loop variable assigned
+		{`s:=0; for i:=0;i<5;i++ { if i==2 { i+=2 }; s+=i }; return s`, 5.0},             // loop variable assigned
+		{`f:=0; for i:=0;i<3;i++ { if i==0 { f=func(){ return i } } }; return f()`, 3.0}, // loop variable captured
+		{`s:=0; n:=5; for i:=0;i<n;i++ { n--; s+=i }; return s`, 3.0},                    // limit changes
+		{`s:=0; n:=5; g:=func(){ n-- }; for i:=0;i<n;i++ { g(); s+=i }; return s`, 3.0},  // limit changes in a function
+		{`s:=0; for i:=0;i<5;i-- { s+=i; if s < -3 { break } }; return s`, -6.0},         // wrong direction
+		{`s:=0; a:=0.5; for i:=a;i<3;i++ { s+=i }; return s`, 4.5},                       // not an integer
+		{`s:=0; for i:=0;i<5;i+=2 { s+=i }; return s`, 6.0},                              // converted
+		{`s:=0; for i:=1;i<i*2 && i<20;i*=2 { s+=i }; return s`, 31.0},                   // not a counting loop
+	} {
+		convertEval(t, src.src, src.expected)
+	}
+	assert.True(t, strings.Contains(convert(t, `s:=0; for i:=0;i<5;i++ { s+=i; i++ }; return s`), "while"))
+	assert.True(t, strings.Contains(convert(t, `s:=0; n:=5; for i:=0;i<n;i++ { n--; s+=i }; return s`), "while"))
+}
+
+func TestCondExpr(t *testing.T) {
+	convertEval(t, `a:=true; return a?1:2`, 1.0)
+	convertEval(t, `a:=false; return a?1:2`, 2.0)
+	convertEval(t, `a:=true; return a?false:true`, false)
+	convertEval(t, `a:=true; b:=a?undefined:1; return b==undefined`, true)
+	convertEval(t, `a:=1; b:=a>0?(a>1?"big":false):"neg"; return b`, false)
+	convertEval(t, `a:=1; b:=a>0 && (a>1?false:"one"); return b`, "one")
+	convertEval(t, `a:=1; b:=a>1 || (a>0?false:true); return b`, false)
+	convertEval(t, `s:=0; for x:=0; (x<3?true:false); x++ { s+=x }; return s`, 3.0)
+	convertEval(t, `n:=0; f:=func(){ n++; return false }; a:=true; b:=a?f():f(); return [b, n]`, ARR{false, 1.0})
+	convertEval(t, `n:=0; f:=func(x){ n++; return x }; a:=true; b:=[f(1), a?f(false):2]; return n`, 2.0)
+	convertEval(t, `f:=func(a){ return a?undefined:1 }; return f(false)`, 1.0)
+
+	// expressions are not hoisted before the calls and the reads evaluated
+	// before them
+	convertEval(t, `a := true; g := func() { a = false; return 0 }; x := [g(), a ? undefined : 1]; return x[1]`, 1.0)
+	convertEval(t, `a := 1; g := func() { a = 2; return false }; x := [a, g() ? undefined : 5]; return x[0]`, 1.0)
+	out := convert(t, `a := 1; g := func() { return false }; x := [1, g() ? undefined : 5]; return x`)
+	assert.True(t, strings.Contains(out, "if g() then"), out)
+
+	// the operands evaluated before a hoisted expression are evaluated into
+	// temporary variables first
+	src := `n := 0; f := func() { n++; return n }; g := func() { n *= 10; return n }; c := false; x := 1; return [f() + (c ? x : g()), n]`
+	out = convert(t, src)
+	assert.False(t, strings.Contains(out, "(function()"), out)
+	assert.True(t, strings.Contains(out, "local __t1__=f()\nlocal __t2__\nif c then"), out)
+	convertEval(t, src, ARR{11.0, 10.0})
+	convertEval(t, `m := {}; k := func() { m.a = 1; return "a" }; c := false; return m[k()] + (c ? undefined : m.a)`, 2.0)
+
+	for _, src := range []string{
+		`a:=true; return a?1:2`,
+		`a:=true; return a?false:true`,
+		`a:=1; return a>0?(a>1?"big":false):"neg"`,
+		`a:=1; return a>0 && (a>1?false:"one")`,
+		`s:=0; for x:=0; (x<3?true:false); x++ { s+=x }; return s`,
+		`f:=func(x){ return x }; a:=true; return a?f(false):f(true)`,
+	} {
+		out = convert(t, src)
+		assert.False(t, strings.Contains(out, "function()"), out)
+	}
+}
+
+func TestPrecedence(t *testing.T) {
+	convertEval(t, `a:=2; b:=3; c:=4; return a+b*c`, 14.0)
+	convertEval(t, `a:=2; b:=3; c:=4; return (a+b)*c`, 20.0)
+	convertEval(t, `a:=2; b:=3; c:=4; return a-(b-c)`, 3.0)
+	convertEval(t, `a:=2; b:=3; c:=4; return a-b-c`, -5.0)
+	convertEval(t, `a:=2; b:=3; return -(a-b)`, 1.0)
+	convertEval(t, `a:=2; return - -a`, 2.0)
+	convertEval(t, `a:=2; return -(-a)`, 2.0)
+	convertEval(t, `a:=2; return +a`, 2.0)
+	convertEval(t, `a:=true; b:=false; return !(a && b)`, true)
+	convertEval(t, `a:=true; b:=false; return !a || b`, false)
+	convertEval(t, `a:=1; b:=2; return !(a < b) == false`, true)
+	convertEval(t, `m:={a:{b:1}, "end": 2, "a b": 3}; return m.a.b + m["end"] + m["a b"]`, 6.0)
+	convertEval(t, `return [1,2,3][1]`, 2.0)
+	convertEval(t, `return {a:5}.a`, 5.0)
+	convertEval(t, `f:=func(){ return [1,2] }; return (f())[1]`, 2.0)
+
+	for _, c := range []struct {
+		src      string
+		expected string
+	}{
+		{`a:=1; b:=2; c:=3; x:=a+b*c`, "local x=a + b * c"},
+		{`a:=1; b:=2; c:=3; x:=(a+b)*c`, "local x=(a + b) * c"},
+		{`a:=1; b:=2; c:=3; x:=a-(b-c)`, "local x=a - (b - c)"},
+		{`a:=1; x:=-(-a)`, "local x=- -a"},
+		{`a:=true; b:=false; x:=!(a && b)`, "local x=not (a and b)"},
+		{`a:=true; b:=false; c:=1; x:=a || b && c > 1`, "local x=a or b and c > 1"},
+		{`a:={b:{c:1}}; x:=a.b.c`, "local x=a.b.c"},
+		{`a:={}; x:=a["end"]`, `local x=a["end"]`},
+		{`a:={x:1}; x:=a["x"]*2`, "local x=a.x * 2"},
+		{`x:={a:1, "b c":2}`, `local x={a=1,["b c"]=2}`},
+		{`a:=true; x:=a?1:2`, "local x=a and 1 or 2"},
+	} {
+		out := convert(t, c.src)
+		assert.True(t, strings.Contains(out, c.expected), "expected: %s\n%s", c.expected, out)
+	}
+}
+
+func TestCompoundAssignment(t *testing.T) {
+	// the container and the key are evaluated only once
+	convertEval(t, `n:=0; f:=func(){ n++; return 1 }; a:=[1,2]; a[f()]+=5; return [a, n]`, ARR{ARR{1.0, 7.0}, 1.0})
+	convertEval(t, `n:=0; f:=func(){ n++; return 1 }; a:=[1,2]; a[f()]++; a[f()-1]--; return [a, n]`, ARR{ARR{0.0, 3.0}, 2.0})
+	convertEval(t, `n:=0; m:={x:{y:1}}; g:=func(){ n++; return "x" }; m[g()].y*=3; return [m.x.y, n]`, ARR{3.0, 1.0})
+	convertEval(t, `n:=0; f:=func(){ n++; return 1 }; a:=[1,2]; a[f()]+=f(); return [a, n]`, ARR{ARR{1.0, 3.0}, 2.0})
+	convertEval(t, `a:=[1,2]; c:=true; a[c?1:0]+=1; return a`, ARR{1.0, 3.0})
+
+	// simple targets are not hoisted
+	out := convert(t, `a:=[1,2]; i:=1; a[i]+=1; a[0]++`)
+	assert.False(t, strings.Contains(out, "__t1__"), out)
+}
+
+func TestLayout(t *testing.T) {
+	opts := testOptions()
+	opts.Indent = "\t"
+	out := convertOpts(t, `
+g := func(a) { return a }
+f := func(a, b) {
+	if a > b { return a } else { return g(b) }
+}
+x := f(1, 2)
+for x > 0 { x -= f(x, 1) * -3 }
+`, opts)
+	assert.Equal(t, `local g=function(a)
+	return a
+end
+local f=function(a,b)
+	do
+		if a > b then
+			return a
+		else
+			return (g(b))
+		end
+	end
+end
+local x=f(1,2)
+while x > 0 do
+	x=x - f(x,1) * -3
+end
+`, out)
+}
+
+func TestFoldConstants(t *testing.T) {
+	opts := testOptions()
+	opts.FoldConstants = true
+
+	// Tengo semantics
+	convertEvalOpts(t, `return 60 * 60 * 24`, opts, 86400.0)
+	convertEvalOpts(t, `return 7 / 2`, opts, 3.0)
+	convertEvalOpts(t, `return -7 % 3`, opts, -1.0)
+	convertEvalOpts(t, `return 1 == 1.0`, opts, false)
+	convertEvalOpts(t, `return "a" + "b" + 1 + 1.5`, opts, "ab11.5")
+	convertEvalOpts(t, `a := 5; return 1 > 2 ? 0 : a`, opts, 5.0)
+	convertEvalOpts(t, `a := 0; if b := 1; 1 + 1 == 2 { a = b + 1 } else { a = 10 }; return a`, opts, 2.0)
+	convertEvalOpts(t, `a := 0; if false { a = 1 } else if a == 0 { a = 2 } else { a = 3 }; return a`, opts, 2.0)
+	convertEvalOpts(t, `a := 0; for i := 0; 1 < 0; i++ { a++ }; return a`, opts, 0.0)
+	convertEvalOpts(t, `a := 0; for 1 > 0 { a++; if a == 3 { break } }; return a`, opts, 3.0)
+
+	// conditions and logical operators follow the converted code
+	for _, c := range []struct {
+		src      string
+		expected interface{}
+	}{
+		{`return !0 && !""`, false},
+		{`return 0 || "" || "x"`, 0.0},
+		{`return 0 && 5`, 5.0},
+		{`return undefined || 5`, 5.0},
+		{`return 0 ? "a" : "b"`, "a"},
+		{`a := 1; if "" { a = 2 }; return a`, 2.0},
+	} {
+		opts.FoldConstants = true
+		convertEvalOpts(t, c.src, opts, c.expected)
+		opts.FoldConstants = false
+		convertEvalOpts(t, c.src, opts, c.expected)
+	}
+	opts.FoldConstants = true
+
+	for _, c := range []struct {
+		src      string
+		expected string
+	}{
+		{`x := 60 * 60 * 24`, "local x=86400\n"},
+		{`x := "a" + "b"`, `local x="ab"` + "\n"},
+		{`x := -(2 * 3.5)`, "local x=-7.0\n"},
+		{`x := 1 < 2 && 3 != 4`, "local x=true\n"},
+		{`x := 0 && 5`, "local x=5\n"},
+		{`x := 1; if false { x = 2 }`, "local x=1\n"},
+		{`x := 1; if 2 > 1 { x = 2 } else { x = 3 }`, "local x=1\ndo\n  x=2\nend\n"},
+		{`x := 1; for false { x = 2 }`, "local x=1\n"},
+		{`x := 1; for 1 > 0 { x = 2 }`, "local x=1\nwhile true do\n  x=2\nend\n"},
+		// runtime errors and values without Lua literals are not folded
+		{`x := 1 / 0`, "local x=1 / 0\n"},
+		{`x := 1.0 / 0`, "local x=1.0 / 0\n"},
+	} {
+		assert.Equal(t, c.expected, convertOpts(t, c.src, opts))
+	}
+
+	// positions are kept
+	convertErrorOpts(t, "if false {\n  x := 1\n}\ny := 2 * 3 + 'c'", opts, "script:4:14")
+
+	// the optimization is disabled by default
+	assert.Equal(t, "local x=60 * 60\n", convert(t, `x := 60 * 60`))
+}
+
+func TestInferTypes(t *testing.T) {
+	for _, c := range []struct {
+		src      string
+		expected string
+	}{
+		{
+			`a := 1; b := 1.5; c := "s"; d := true; e := [1]; f := {}; g := func() {}
+			return [a, b, c, d, e, f, g, a + b, a / 2, c + a, len(c), a < b, -b, !a, e[0], e[1:], undefined]`,
+			"[int float string bool array map function float int string int bool float bool unknown array unknown]",
+		},
+		// flow-sensitive: types of the branches and the loops are joined
+		{`a := 1; a = "s"; return [a]`, "[string]"},
+		{`c := true; a := 1; if c { a = "s" }; return [a]`, "[unknown]"},
+		{`c := true; a := 1; if c { a = 2 } else { a += 3 }; return [a]`, "[int]"},
+		{`a := 1; for i := 0; i < 3; i++ { a = a + 0.5 }; return [a]`, "[unknown]"},
+		{`a := 1; for i := 0; i < 3; i++ { a = a * 2 }; return [a]`, "[int]"},
+		{`a := 1; b := 2; for k, v in {x: 1} { a = k; b = v }; return [a, b]`, "[unknown unknown]"},
+		{`a := ""; for k, v in {x: 1} { a = k }; return [a]`, "[string]"},
+		// functions
+		{`a := 1; f := func(x) { return [a, x] }; return [a]`, "[int]"},
+		{`a := 1; f := func() { a = "x" }; return [a]`, "[unknown]"},
+		{`f := func(x) { y := 1; return [y, x] }; return [f]`, "[function]"},
+	} {
+		tr := tengo2lua.NewTranspiler([]byte(c.src), nil)
+		info, err := tr.InferTypes()
+		if !assert.NoError(t, err) {
+			continue
+		}
+		ret := info.File.Stmts[len(info.File.Stmts)-1].(*ast.ReturnStmt)
+		var types []tengo2lua.Type
+		for _, elem := range ret.Result.(*ast.ArrayLit).Elements {
+			types = append(types, info.TypeOf(elem))
+		}
+		assert.Equal(t, c.expected, fmt.Sprint(types), c.src)
+	}
+
+	// types of the variables in functions
+	tr := tengo2lua.NewTranspiler([]byte(`a := 1; f := func(x) { y := 1; return [a, x, y] }`), nil)
+	info, err := tr.InferTypes()
+	assert.NoError(t, err)
+	var types []tengo2lua.Type
+	for expr, typ := range info.Types {
+		if arr, ok := expr.(*ast.ArrayLit); ok {
+			for _, elem := range arr.Elements {
+				types = append(types, info.Types[elem])
+			}
+			assert.Equal(t, 1, info.Position(arr.Pos()).Line)
+			assert.Equal(t, "array", typ.String())
+		}
+	}
+	assert.Equal(t, "[unknown unknown int]", fmt.Sprint(types))
+
+	// direct Lua operations are used for known types
+	out := convert(t, `a := "x"; b := a + "y" + 1`)
+	assert.True(t, strings.Contains(out, `local b=a .. "y" .. 1`), out)
+	assert.False(t, strings.Contains(out, "__add__"), out)
+	out = convert(t, `a := 1; b := a + 2`)
+	assert.False(t, strings.Contains(out, "__add__"), out)
+	out = convert(t, `m := {a: 1}; for k, v in m {}`)
+	assert.True(t, strings.Contains(out, "in pairs(m)"), out)
+	assert.False(t, strings.Contains(out, "__iter__"), out)
+	out = convert(t, `s := "abc"; n := len(s)`)
+	assert.True(t, strings.Contains(out, "local n=#s"), out)
+	assert.False(t, strings.Contains(out, "__len__"), out)
+	opts := testOptions()
+	opts.Target = tengo2lua.Lua53
+	out = convertOpts(t, `a := 1.5; b := a / 2`, opts)
+	assert.True(t, strings.Contains(out, "local b=a / 2"), out)
+
+	convertEval(t, `a := "x"; b := a + "y" + 1; return b`, "xy1")
+	convertEval(t, `m := {a: 1, b: 2}; n := 0; for k, v in m { n += v }; return n`, 3.0)
+	convertEval(t, `s := "abc"; return len(s) + len(s + "d")`, 7.0)
+}
+
+func TestPrelude(t *testing.T) {
+	src := `f := func(a, b) { return a + b }; x := [1, 2, 3]; n := len(x); for k, v in x { n += f(k, v) }; return [n, "abc"[0:2]]`
+
+	// the output is reproducible
+	out := convert(t, src)
+	for i := 0; i < 20; i++ {
+		assert.Equal(t, out, convert(t, src))
+	}
+	convertEval(t, src, ARR{12.0, "ab"})
+
+	// helpers in the order of declaration, followed by the builtin functions
+	concat := strings.Index(out, "local __add__ =")
+	iter := strings.Index(out, "local __iter__ =")
+	slice := strings.Index(out, "local __slice__ =")
+	length := strings.Index(out, "local __len__ =")
+	assert.True(t, concat >= 0 && concat < iter && iter < slice && slice < length, out)
+}
+
+func TestHygienicPrelude(t *testing.T) {
+	src := `a := [1, 2, 3]; s := "abc"[0:1]; for k, v in a { s = s + k + v }; return s + len(a)`
+
+	l := lua.NewState()
+	defer l.Close()
+	assert.NoError(t, l.DoString(`len = "host"; x = "1" + 1`))
+
+	opts := testOptions()
+	opts.EnableGlobalScope = true
+	for _, prefix := range []string{"", "tengo_"} {
+		opts.HelperPrefix = prefix
+		out := convertOpts(t, src, opts)
+		assert.True(t, strings.Contains(out, "local __"+prefix+"slice__ ="), out)
+
+		// several scripts share the state with the host code
+		for i := 0; i < 2; i++ {
+			assert.NoError(t, l.DoString(out))
+			assert.Equal(t, "a0112233", l.Get(-1).String())
+			l.Pop(1)
+		}
+	}
+
+	// the prelude defines no globals and does not patch the string metatable
+	for _, name := range []string{"__iter__", "__slice__", "__len__", "__add__", "__n", "__tengo_len__"} {
+		assert.True(t, l.GetGlobal(name) == lua.LNil, name)
+	}
+	assert.Equal(t, "host", l.GetGlobal("len").String())
+	assert.Equal(t, "2", l.GetGlobal("x").String())
+	assert.NoError(t, l.DoString(`assert(getmetatable("").__add == nil)`))
+
+	opts.HelperPrefix = "my-"
+	_, err := tengo2lua.NewTranspiler([]byte(src), opts).Convert()
+	assert.Error(t, err)
+}
+
+func TestBuiltins(t *testing.T) {
+	opts := testOptions()
+	opts.EnableGlobalScope = true
+	opts.Builtins = []tengo2lua.Builtin{
+		{Name: "string", Code: `function(v) return tostring(v) end`},
+		{Name: "sum", Code: `function(v)
+			local s = 0
+			for _, x in $iter(v) do s = $add(s, x) end
+			return s
+		end`, Deps: []string{"iter", "add"}},
+		{Name: "len", Code: `function(v) return 42 end`},
+	}
+	convertEvalOpts(t, `return string(5) + "!"`, opts, "5!")
+	convertEvalOpts(t, `return sum([1, 2, 3]) + sum({a: 4})`, opts, 10.0)
+
+	// the default builtins can be replaced
+	convertEvalOpts(t, `return len("abc")`, opts, 42.0)
+	assert.False(t, strings.Contains(convertOpts(t, `return len("abc")`, opts), "#"))
+
+	// builtin names do not collide with mangled variable names
+	convertEvalOpts(t, `f := func() { return string(1) }; x := f(); string := 2; return [x, string]`, opts, ARR{"1", 2.0})
+
+	// the builtins are part of the runtime module
+	module, err := tengo2lua.RuntimeModule(opts)
+	assert.NoError(t, err)
+	assert.True(t, strings.Contains(module, "sum = __sum__"), module)
+
+	opts.Builtins = []tengo2lua.Builtin{{Name: "f", Code: `function() end`, Deps: []string{"g"}}}
+	convertErrorOpts(t, `f()`, opts, "unknown dependency 'g' of builtin function 'f'")
+	opts.Builtins = []tengo2lua.Builtin{{Name: "iter", Code: `function() end`}}
+	convertErrorOpts(t, `iter()`, opts, "builtin function name 'iter' is used by a helper")
+	opts.Builtins = []tengo2lua.Builtin{{Name: "a-b", Code: `function() end`}}
+	convertErrorOpts(t, `a := 1`, opts, "invalid builtin function name 'a-b'")
+}
+
+func TestHostGlobals(t *testing.T) {
+	l := lua.NewState()
+	defer l.Close()
+	assert.NoError(t, l.DoString(`
+		out = {}
+		function emit(v) out[#out + 1] = v end
+		host = {config = {n = 2}, util = {double = function(v) return v * 2 end}}`))
+
+	run := func(src string, opts *tengo2lua.Options) string {
+		out := convertOpts(t, src, opts)
+		if !assert.NoError(t, l.DoString(out)) {
+			t.Logf("Lua Script:\n%s\n", out)
+		}
+		ret := l.Get(-1).String()
+		l.Pop(1)
+		return ret
+	}
+
+	// Lua globals
+	opts := testOptions()
+	opts.HostGlobals = []tengo2lua.HostGlobal{
+		{Name: "emit"},
+		{Name: "send", LuaName: "emit"},
+		{Name: "double", LuaName: "host.util.double"},
+	}
+	assert.Equal(t, "6", run(`emit(1); send(2); return double(3)`, opts))
+	assert.Equal(t, "2", l.GetGlobal("out").(*lua.LTable).RawGetInt(2).String())
+
+	// the variables of the script shadow the host globals
+	assert.Equal(t, "5", run(`emit := func(v) { return v + 1 }; return emit(4)`, opts))
+	convertErrorOpts(t, `emit := 1; f := func() { send(2) }`, opts, "host global 'send' is shadowed by variable 'emit'")
+
+	// fields of a host table
+	opts = testOptions()
+	opts.HostTable = "host"
+	opts.HostGlobals = []tengo2lua.HostGlobal{
+		{Name: "config"},
+		{Name: "double", LuaName: "util.double"},
+	}
+	opts.Minify = true
+	out := convertOpts(t, `return double(config.n)`, opts)
+	assert.Equal(t, "return(host.util.double(host.config.n))\n", out)
+	assert.Equal(t, "4", run(`return double(config.n)`, opts))
+
+	convertErrorOpts(t, `emit(1)`, opts, "unresolved reference 'emit'")
+	opts.HostGlobals = []tengo2lua.HostGlobal{{Name: "len"}}
+	convertErrorOpts(t, `a := 1`, opts, "host global 'len' conflicts with a builtin function")
+	opts.HostGlobals = []tengo2lua.HostGlobal{{Name: "f", LuaName: "a..b"}}
+	convertErrorOpts(t, `a := 1`, opts, "invalid Lua name 'host.a..b' of host global 'f'")
+}
+
+func TestHostAPI(t *testing.T) {
+	api, err := tengo2lua.ParseHostAPI("host.d", []byte(`
+		// host functions
+		func emit(value)
+		func log(level string, args ...)
+		func clamp(x float, min float, max float) float
+		func name() string
+		var config map
+		const version = "1.2.0"
+		const max_items = 100
+		const ratio = -0.5
+		const debug = false`))
+	assert.NoError(t, err)
+	assert.Equal(t, 3, len(api.Funcs["clamp"].Params))
+	assert.True(t, api.Funcs["log"].Variadic)
+	assert.Equal(t, "string", api.Funcs["name"].Result.String())
+	assert.Equal(t, "map", api.Vars["config"].String())
+	assert.Equal(t, int64(100), api.Consts["max_items"].Value)
+
+	opts := testOptions()
+	opts.HostAPI = api
+	opts.HostGlobals = []tengo2lua.HostGlobal{{Name: "log", LuaName: "print"}}
+	out := convertOpts(t, `log("info", version, max_items, ratio, debug); emit(clamp(1, 0, 2) + 1); return name() + "!" + config.x`, opts)
+	assert.True(t, strings.Contains(out, `print("info","1.2.0",100,-0.5,false)`), out)
+	assert.True(t, strings.Contains(out, `return (__add__(name() .. "!",config.x))`), out)
+
+	// the calls are checked
+	convertErrorOpts(t, `emit()`, opts, "wrong number of arguments in call to 'emit': want 1, got 0\n\tat script:1:1")
+	convertErrorOpts(t, `clamp(1, 2)`, opts, "wrong number of arguments in call to 'clamp': want 3, got 2")
+	convertErrorOpts(t, `log()`, opts, "not enough arguments in call to 'log': want at least 1, got 0")
+	convertErrorOpts(t, `a := "x"; clamp(0, a, 2)`, opts, "cannot use string as float value of parameter 'min' in call to 'clamp'\n\tat script:1:20")
+	convertErrorOpts(t, `log(max_items)`, opts, "cannot use int as string value of parameter 'level' in call to 'log'")
+
+	// unknown types are accepted, and the script can shadow the host API
+	convertEvalOpts(t, `f := func(a) { return clamp(a, a, a) }; clamp := func(x) { return x }; return clamp(version)`, opts, "1.2.0")
+
+	// constants that have no Lua literal
+	api, err = tengo2lua.ParseHostAPI("host.d", []byte(`const big = 9007199254740993`))
+	assert.NoError(t, err)
+	opts.HostAPI = api
+	convertErrorOpts(t, `x := big`, opts, "host constant 'big' cannot be represented in Lua 5.1")
+
+	for src, expected := range map[string]string{
+		"func f(a int":     "host.d:1:13: expected ',', found end of file",
+		"func f(a ..., b)": "host.d:1:15: variadic parameter must be the last one",
+		"var x number":     "host.d:1:7: unknown type 'number'",
+		"const x = y":      "host.d:1:11: invalid constant value 'y'",
+		"func f()\nvar f":  "host.d:2:1: 'f' redeclared",
+		"type t int":       "host.d:1:1: expected 'func', 'var' or 'const', found 'type'",
+		"const s = \"a":    "host.d:1:11: literal not terminated",
+	} {
+		_, err := tengo2lua.ParseHostAPI("host.d", []byte(src))
+		assert.True(t, err != nil && err.Error() == expected, "%s: %v", src, err)
+	}
+}
+
+func TestInputs(t *testing.T) {
+	src := `total := a + b
+count += 1
+count++
+result = total * 2
+f := func() { return c.x }
+c.y = f()
+b := 0
+return [total, b]`
+
+	opts := testOptions()
+	opts.InputTable = "input"
+	tr := tengo2lua.NewTranspiler([]byte(src), opts)
+	out, err := tr.Convert()
+	assert.NoError(t, err)
+
+	var inputs []string
+	for _, input := range tr.Inputs() {
+		var reads, writes []string
+		for _, pos := range input.Reads {
+			reads = append(reads, fmt.Sprint(pos.Line, ":", pos.Column))
+		}
+		for _, pos := range input.Writes {
+			writes = append(writes, fmt.Sprint(pos.Line, ":", pos.Column))
+		}
+		inputs = append(inputs, fmt.Sprintf("%s r%v w%v", input.Name, reads, writes))
+	}
+	assert.Equal(t, "[a r[1:10] w[] b r[1:14] w[] c r[5:22 6:1] w[] count r[2:1 3:1] w[2:1 3:1] result r[] w[4:1]]", fmt.Sprint(inputs))
+
+	l := lua.NewState()
+	defer l.Close()
+	assert.NoError(t, l.DoString(`input = {a = 1, b = 2, c = {x = 5}, count = 10}`))
+	assert.NoError(t, l.DoString(out))
+	assertEqual(t, ARR{3.0, 0.0}, fromLV(l.Get(-1)))
+	input := l.GetGlobal("input").(*lua.LTable)
+	assert.Equal(t, "6", l.GetField(input, "result").String())
+	assert.Equal(t, "12", l.GetField(input, "count").String())
+	assert.Equal(t, "5", l.GetField(l.GetField(input, "c"), "y").String())
+
+	// the builtin functions and the host globals are not inputs
+	opts.HostGlobals = []tengo2lua.HostGlobal{{Name: "emit"}}
+	tr = tengo2lua.NewTranspiler([]byte(`emit(len(x))`), opts)
+	_, err = tr.Convert()
+	assert.NoError(t, err)
+	assert.Equal(t, 1, len(tr.Inputs()))
+	convertErrorOpts(t, `emit = 1`, opts, "unresolved reference 'emit'")
+	convertErrorOpts(t, `input := 1; return x`, opts, "input table 'input' is shadowed by a variable")
+
+	// without the input mode, the unresolved references are errors
+	convertError(t, `return x`, "unresolved reference 'x'")
+}
+
+func TestCallRules(t *testing.T) {
+	opts := testOptions()
+	opts.CallRules = []tengo2lua.CallRule{
+		{Callee: "max", Template: "math.max($1, $2)"},
+		{Callee: "sq", Template: "$1 * $1"},
+		{Callee: "fmt.sprintf", Template: "string.format($*)"},
+		{Callee: "log.info", Template: "print($1)"},
+		{Callee: "swap", Template: "{[0]=$2, $1, __a=true}"},
+		{Callee: "second", Template: "$2"},
+		{Callee: "rsub", Template: "$2 - $1"},
+		{Callee: "both", Template: "$1 and $2"},
+	}
+
+	out := convertOpts(t, `a := 1; b := 2; return max(a + b, b) * 2`, opts)
+	assert.True(t, strings.Contains(out, "return (math.max((a + b), b)) * 2"), out)
+	convertEvalOpts(t, `a := 1; b := 2; return max(a + b, b) * 2`, opts, 6.0)
+	convertEvalOpts(t, `return fmt.sprintf("%d-%s", 1, "x")`, opts, "1-x")
+	convertEvalOpts(t, `log.info("x"); return sq(3)`, opts, 9.0)
+
+	// arguments with side effects are evaluated once, in order
+	src := `n := 0; f := func() { n++; return n }; r := sq(f()); s := swap(f(), f()); return [r, s[0], s[1], n]`
+	out = convertOpts(t, src, opts)
+	assert.True(t, strings.Contains(out, "function(__a1__)"), out)
+	convertEvalOpts(t, src, opts, ARR{1.0, 3.0, 2.0, 3.0})
+	convertEvalOpts(t, `n := 0; f := func() { n++; return n }; return [second(f(), f()), n]`, opts, ARR{2.0, 2.0})
+	src = `n := 0; f := func() { n++; return false }; g := func() { n += 10; return true }; return [both(f(), g()), n]`
+	out = convertOpts(t, src, opts)
+	assert.True(t, strings.Contains(out, "function(__a1__,__a2__)"), out)
+	convertEvalOpts(t, src, opts, ARR{false, 11.0})
+	assert.True(t, strings.Contains(convertOpts(t, `x := 1; y := 2; return both(x, y)`, opts), "return x and y"))
+
+	// variables are read between the same calls as in the script
+	convertEvalOpts(t, `x := 1; f := func() { x = 10; return 2 }; return rsub(x, f())`, opts, 1.0)
+	convertEvalOpts(t, `x := 1; f := func() { x = 10; return 2 }; return rsub(f(), x)`, opts, 8.0)
+	assert.True(t, strings.Contains(convertOpts(t, `x := 1; y := 2; return rsub(x, y)`, opts), "return y - x"))
+
+	// the rules do not apply to the variables of the script
+	convertEvalOpts(t, `max := func(a, b) { return a }; return max(1, 2)`, opts, 1.0)
+	convertEvalOpts(t, `log := {info: func(x) { return x }}; return log.info(5)`, opts, 5.0)
+
+	// the names of the template are not used by the minifier
+	opts.Minify = true
+	opts.CallRules = []tengo2lua.CallRule{{Callee: "first", Template: "a[$1]"}}
+	opts.AllowedGlobals = []string{"a"}
+	out = convertOpts(t, `x := 1; return first(x)`, opts)
+	assert.Equal(t, "local b=1\nreturn a[b]\n", out)
+	opts.Minify = false
+
+	opts.CallRules = []tengo2lua.CallRule{{Callee: "max", Template: "mylib.max($1, $2)"}}
+	convertErrorOpts(t, `max(1)`, opts, "not enough arguments in call to 'max': want 2, got 1")
+	convertErrorOpts(t, `max(1, 2, 3)`, opts, "too many arguments in call to 'max': want 2, got 3")
+	convertErrorOpts(t, `mylib := 1; return max(1, 2)`, opts, "call rule 'max' refers to 'mylib', which is shadowed by a variable")
+	opts.CallRules = []tengo2lua.CallRule{{Callee: "f", Template: "$0"}}
+	convertErrorOpts(t, `f()`, opts, "invalid argument '$0' in template of call rule 'f'")
+	opts.CallRules = []tengo2lua.CallRule{{Callee: "a..b", Template: "1"}}
+	convertErrorOpts(t, `f()`, opts, "invalid callee 'a..b' of call rule")
+}
+
+func TestHooks(t *testing.T) {
+	opts := testOptions()
+	opts.AllowedGlobals = []string{"count"}
+	opts.Hooks = []tengo2lua.Hook{
+		// string literals are upper-cased
+		func(ctx *tengo2lua.HookContext, node ast.Node) (*tengo2lua.LuaCode, error) {
+			if _, ok := node.(*ast.StringLit); !ok {
+				return nil, nil
+			}
+			code, err := ctx.Default()
+			if err != nil {
+				return nil, err
+			}
+			return ctx.Expr("string.upper($1)", code)
+		},
+		// the definitions are counted
+		func(ctx *tengo2lua.HookContext, node ast.Node) (*tengo2lua.LuaCode, error) {
+			if _, ok := node.(*ast.AssignStmt); !ok {
+				return nil, nil
+			}
+			code, err := ctx.Default()
+			if err != nil {
+				return nil, err
+			}
+			incr, err := ctx.Stmt("if count == nil then\n" + ctx.Indent() + "count = 0\nend\ncount = count + 1")
+			if err != nil {
+				return nil, err
+			}
+			return ctx.Stmts(code, incr)
+		},
+		// "count" reads the counter, and "size(x)" calls the builtin "len"
+		func(ctx *tengo2lua.HookContext, node ast.Node) (*tengo2lua.LuaCode, error) {
+			switch node := node.(type) {
+			case *ast.Ident:
+				if node.Name == "count" {
+					return ctx.Expr("count")
+				}
+			case *ast.CallExpr:
+				if ident, ok := node.Func.(*ast.Ident); ok && ident.Name == "size" && len(node.Args) == 1 {
+					name, err := ctx.Helper("len")
+					if err != nil {
+						return nil, err
+					}
+					arg, err := ctx.Convert(node.Args[0])
+					if err != nil {
+						return nil, err
+					}
+					return ctx.Expr(name+"($1)", arg)
+				}
+			case *ast.FloatLit:
+				return nil, ctx.Errorf(node, "floats are not supported")
+			}
+			return nil, nil
+		},
+	}
+
+	convertEvalOpts(t, `a := "x"; b := a + "y"; return [a, b]`, opts, ARR{"X", "XY"})
+	convertEvalOpts(t, `a := [1, 2]; f := func() { b := 1; return count }; return [f(), count, size(a)]`, opts, ARR{3.0, 3.0, 2.0})
+	out := convertOpts(t, `f := func() { b := 1 }`, opts)
+	assert.True(t, strings.Contains(out, "\n  if count == nil then\n    count = 0\n  end\n  count = count + 1\n"), out)
+
+	opts.Minify = true
+	convertEvalOpts(t, `a := "x"; b := [a, size(a)]; return [b, count]`, opts, ARR{ARR{"X", 1.0}, 2.0})
+	opts.Minify = false
+
+	convertErrorOpts(t, `a := 1.5`, opts, "floats are not supported")
+	convertErrorOpts(t, `count := 1`, opts, "hook template refers to 'count', which is shadowed by a variable")
+
+	// the expressions converted by hooks may have side effects, so they are
+	// evaluated before the hoisted statements
+	out = convertOpts(t, `a := true; x := ["s", a ? undefined : 1]`, opts)
+	assert.False(t, strings.Contains(out, "function()"), out)
+	assert.True(t, strings.Contains(out, "local __t1__=string.upper(\"s\")\nlocal __t2__\nif a then"), out)
+	out = convertOpts(t, `f := func() { return 1 }; c := false; x := 1; return f() + (c ? x : 2)`, opts)
+	assert.False(t, strings.Contains(out, "(function()"), out)
+	assert.True(t, strings.Contains(out, "local __t1__=f()\nlocal __t2__\nif c then"), out)
+
+	opts.Hooks = []tengo2lua.Hook{
+		func(ctx *tengo2lua.HookContext, node ast.Node) (*tengo2lua.LuaCode, error) {
+			switch node.(type) {
+			case *ast.ReturnStmt:
+				return ctx.Expr("1")
+			case *ast.IntLit:
+				return ctx.Stmts()
+			case *ast.BoolLit:
+				return ctx.Expr("f($1)")
+			case *ast.StringLit:
+				if _, err := ctx.Helper("nope"); err != nil {
+					return nil, err
+				}
+			}
+			return nil, nil
+		},
+	}
+	convertErrorOpts(t, `return`, opts, "hook returned an expression for a statement")
+	convertErrorOpts(t, `a := 1`, opts, "hook returned statements for an expression")
+	convertErrorOpts(t, `a := true`, opts, "wrong number of arguments for hook template 'f($1)': want 1, got 0")
+	convertErrorOpts(t, `a := "x"`, opts, "unknown helper function 'nope'")
+}
+
+func TestRuntime(t *testing.T) {
+	src := `a := [1, 2, 3]; s := "abc"[0:1]; for k, v in a { s = s + k + v }; return s + len(a)`
+
+	opts := testOptions()
+	for _, minify := range []bool{false, true} {
+		opts.Minify = minify
+		module, err := tengo2lua.RuntimeModule(opts)
+		assert.NoError(t, err)
+		assert.False(t, strings.Contains(module, "div"), module)
+
+		l := lua.NewState()
+		assert.NoError(t, l.DoString(module))
+		runtime := l.Get(-1)
+		l.Pop(1)
+
+		// the module is loaded with "require"
+		opts.Runtime = tengo2lua.RuntimeRequire
+		out := convertOpts(t, src, opts)
+		assert.True(t, strings.Contains(out, `require("tengo2lua")`), out)
+		assert.False(t, strings.Contains(out, "pairs"), out)
+		l.SetField(l.GetField(l.GetGlobal("package"), "loaded"), "tengo2lua", runtime)
+		assert.NoError(t, l.DoString(out))
+		assert.Equal(t, "a0112233", l.Get(-1).String())
+		l.Pop(1)
+
+		// the host provides the module
+		opts.Runtime = tengo2lua.RuntimeHost
+		opts.RuntimeName = "rt"
+		out = convertOpts(t, src, opts)
+		l.SetGlobal("rt", runtime)
+		assert.NoError(t, l.DoString(out))
+		assert.Equal(t, "a0112233", l.Get(-1).String())
+		l.Pop(1)
+
+		// the version of the module is checked
+		opts.Target = tengo2lua.Lua52
+		module, err = tengo2lua.RuntimeModule(opts)
+		assert.NoError(t, err)
+		assert.NoError(t, l.DoString(module))
+		l.SetGlobal("rt", l.Get(-1))
+		err = l.DoString(out)
+		assert.True(t, err != nil && strings.Contains(err.Error(), "incompatible runtime"), err)
+
+		// no runtime is needed
+		out = convertOpts(t, `a := 1`, opts)
+		assert.False(t, strings.Contains(out, "rt"), out)
+
+		opts.Target = tengo2lua.Lua51
+		opts.Runtime = tengo2lua.RuntimeInline
+		opts.RuntimeName = ""
+		l.Close()
+	}
+
+	// the runtime depends on the target
+	opts.Target = tengo2lua.Lua53
+	module, err := tengo2lua.RuntimeModule(opts)
+	assert.NoError(t, err)
+	assert.True(t, strings.Contains(module, "div=__div__"), module)
+
+	opts.Runtime = tengo2lua.RuntimeHost
+	opts.RuntimeName = "a.b"
+	convertErrorOpts(t, src, opts, "invalid runtime global name 'a.b'")
+}
+
+func TestMinify(t *testing.T) {
+	// many locals: the short names must skip the Lua keywords
+	var sb strings.Builder
+	for i := 0; i < 100; i++ {
+		sb.WriteString(fmt.Sprintf("v%d := %d\n", i, i))
+	}
+	sb.WriteString("return v0 + v50 + v99")
+
+	srcs := []string{
+		sb.String(),
+		`fib := undefined; fib = func(n) { if n < 2 { return n }; return fib(n-1) + fib(n-2) }; return fib(10)`,
+		`fib := func(n) { if n < 2 { return n }; return fib(n-1) + fib(n-2) }; return fib(10)`,
+		`total := 0; for i := 0; i < 10; i++ { if i % 2 == 0 { continue }; total += i }; return total`,
+		`a := [1, 2, 3]; s := 0; for k, v in a { s -= -v * k }; return [s, "abc"[1:2], len(a)]`,
+		`m := {a: 1, "b c": 2}; n := 0; for k, v in m { n += v }; return n`,
+		`x := 1; f := func(y) { x := 10; return func(z) { return x + y + z } }; return f(2)(3) + x`,
+		`a := 1.5; b := -a; return [a - -b, 1 - -1, "a" + "b"]`,
+		`a := true; c := 0; return a ? (c > 0 ? "p" : "z") : "n"`,
+	}
+
+	opts := testOptions()
+	minOpts := testOptions()
+	minOpts.Minify = true
+	for _, src := range srcs {
+		out := convertOpts(t, src, opts)
+		minOut := convertOpts(t, src, minOpts)
+		assert.True(t, len(minOut) < len(out), "%s\n%s", out, minOut)
+
+		l := lua.NewState()
+		assert.NoError(t, l.DoString(out))
+		expected := fromLV(l.Get(-1))
+		l.Close()
+		if !eval(t, minOut, expected) {
+			t.Logf("Lua Script:\n%s\n", minOut)
+		}
+	}
+
+	out := convertOpts(t, `total := 0; add := func(n) { total = total * n }; add(1); return -total`, minOpts)
+	assert.Equal(t, "local a=0\nlocal b=function(c)\na=a*c\nend\nb(1)\nreturn-a\n", out)
+
+	// a recursive function refers to its own local, not to its parameter
+	src := `f := func(x) { return x < 1 ? 1 : x * f(x - 1) }; return f(3)`
+	out = convertOpts(t, src, minOpts)
+	assert.Equal(t, "local a\na=function(b)\nreturn b<1 and 1 or b*a(b-1)\nend\nreturn(a(3))\n", out)
+	convertEvalOpts(t, src, minOpts, 6.0)
+
+	// unused helpers are left out
+	out = convertOpts(t, `add := func(a, b) { return a + b }`, minOpts)
+	assert.Equal(t, "local __add__=function(a,b)if type(a)==\"string\"then return a..b end return a+b end\nlocal a=function(b,c)\nreturn(__add__(b,c))\nend\n", out)
+
+	// global names are not shadowed
+	minOpts.EnableGlobalScope = true
+	out = convertOpts(t, `a := 1; f := func(x) { return x + a }; return f(2)`, minOpts)
+	assert.True(t, strings.Contains(out, "f=function(b)"), out)
+	convertEvalOpts(t, `a := 1; f := func(x) { return x + a }; return f(2)`, minOpts, 3.0)
+}
+
+func TestValidateOutput(t *testing.T) {
+	// a recursive function refers to the local variable, not to a global:
+	// "local f = function() ... f() ... end" would not be valid
+	src := `f := func() { fib := func(n) { return n < 2 ? n : fib(n-1) + fib(n-2) }; return fib(10) }; return f()`
+	out := convert(t, src)
+	assert.True(t, strings.Contains(out, "local fib\n"), out)
+	assert.True(t, strings.Contains(out, "fib=function(n)"), out)
+	convertEval(t, src, 55.0)
+}
@@ -0,0 +1,434 @@
+package tengo2lua
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/d5/tengo/compiler/source"
+	luaast "github.com/yuin/gopher-lua/ast"
+	luaparse "github.com/yuin/gopher-lua/parse"
+)
+
+// validate parses the generated Lua code and checks that it only uses the
+// syntax and the standard globals of the target Lua dialect and that it does
+// not reference undeclared global variables. Any failure is a transpiler bug and
+// it's reported at the Tengo position that generated the offending line.
+func (t *Transpiler) validate(code string, linePos []source.Pos) error {
+	posOf := func(line int) source.Pos {
+		if line < 1 || line > len(linePos) {
+			return source.NoPos
+		}
+		return linePos[line-1]
+	}
+
+	// gopher-lua parses Lua 5.1 code only
+	code, line, err := toLua51(code, t.options.Target)
+	if err != nil {
+		return t.errorAt(posOf(line), "transpiler bug: %s", err.Error())
+	}
+
+	chunk, err := luaparse.Parse(strings.NewReader(code), "output")
+	if err != nil {
+		line := -1
+		if err, ok := err.(*luaparse.Error); ok {
+			line = err.Pos.Line
+		}
+		return t.errorAt(posOf(line), "transpiler bug: invalid Lua code generated: %s", strings.TrimSpace(err.Error()))
+	}
+
+	c := &globalsChecker{assigned: make(map[string]bool)}
+	c.block(chunk)
+
+	globals := t.options.Target.globals()
+
+	allowed := make(map[string]bool)
+	for _, name := range t.options.AllowedGlobals {
+		allowed[name] = true
+	}
+	if t.options.Runtime == RuntimeHost {
+		allowed[t.options.runtimeName()] = true
+	}
+	for _, path := range t.hostGlobals {
+		allowed[path[0]] = true
+	}
+	if t.options.InputTable != "" {
+		allowed[t.options.InputTable] = true
+	}
+
+	sort.SliceStable(c.refs, func(i, j int) bool {
+		return c.refs[i].Line() < c.refs[j].Line()
+	})
+	for _, ref := range c.refs {
+		if !c.assigned[ref.Value] && !globals[ref.Value] && !allowed[ref.Value] {
+			return t.errorAt(posOf(ref.Line()), "transpiler bug: reference to undeclared global '%s'", ref.Value)
+		}
+	}
+
+	return nil
+}
+
+// globalsChecker walks Lua AST and collects the global variables that are
+// assigned or referenced.
+type globalsChecker struct {
+	scopes   []map[string]bool
+	assigned map[string]bool
+	refs     []*luaast.IdentExpr
+}
+
+func (c *globalsChecker) isLocal(name string) bool {
+	for idx := len(c.scopes) - 1; idx >= 0; idx-- {
+		if c.scopes[idx][name] {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *globalsChecker) declare(names ...string) {
+	for _, name := range names {
+		c.scopes[len(c.scopes)-1][name] = true
+	}
+}
+
+func (c *globalsChecker) open() {
+	c.scopes = append(c.scopes, make(map[string]bool))
+}
+
+func (c *globalsChecker) close() {
+	c.scopes = c.scopes[:len(c.scopes)-1]
+}
+
+func (c *globalsChecker) block(stmts []luaast.Stmt) {
+	c.open()
+	c.stmts(stmts)
+	c.close()
+}
+
+func (c *globalsChecker) stmts(stmts []luaast.Stmt) {
+	for _, stmt := range stmts {
+		c.stmt(stmt)
+	}
+}
+
+func (c *globalsChecker) stmt(stmt luaast.Stmt) {
+	switch stmt := stmt.(type) {
+	case *luaast.AssignStmt:
+		c.exprs(stmt.Rhs)
+		for _, lhs := range stmt.Lhs {
+			if ident, ok := lhs.(*luaast.IdentExpr); ok {
+				if !c.isLocal(ident.Value) {
+					c.assigned[ident.Value] = true
+				}
+				continue
+			}
+			c.expr(lhs)
+		}
+	case *luaast.LocalAssignStmt:
+		c.exprs(stmt.Exprs)
+		c.declare(stmt.Names...)
+	case *luaast.FuncCallStmt:
+		c.expr(stmt.Expr)
+	case *luaast.DoBlockStmt:
+		c.block(stmt.Stmts)
+	case *luaast.WhileStmt:
+		c.expr(stmt.Condition)
+		c.block(stmt.Stmts)
+	case *luaast.RepeatStmt:
+		// the condition can see the locals of the loop body
+		c.open()
+		c.stmts(stmt.Stmts)
+		c.expr(stmt.Condition)
+		c.close()
+	case *luaast.IfStmt:
+		c.expr(stmt.Condition)
+		c.block(stmt.Then)
+		c.block(stmt.Else)
+	case *luaast.NumberForStmt:
+		c.expr(stmt.Init)
+		c.expr(stmt.Limit)
+		c.expr(stmt.Step)
+		c.open()
+		c.declare(stmt.Name)
+		c.stmts(stmt.Stmts)
+		c.close()
+	case *luaast.GenericForStmt:
+		c.exprs(stmt.Exprs)
+		c.open()
+		c.declare(stmt.Names...)
+		c.stmts(stmt.Stmts)
+		c.close()
+	case *luaast.FuncDefStmt:
+		if ident, ok := stmt.Name.Func.(*luaast.IdentExpr); ok {
+			if !c.isLocal(ident.Value) {
+				c.assigned[ident.Value] = true
+			}
+		} else {
+			c.expr(stmt.Name.Func)
+		}
+		c.expr(stmt.Name.Receiver)
+		c.function(stmt.Func, stmt.Name.Method != "")
+	case *luaast.ReturnStmt:
+		c.exprs(stmt.Exprs)
+	}
+}
+
+func (c *globalsChecker) exprs(exprs []luaast.Expr) {
+	for _, expr := range exprs {
+		c.expr(expr)
+	}
+}
+
+func (c *globalsChecker) expr(expr luaast.Expr) {
+	switch expr := expr.(type) {
+	case *luaast.IdentExpr:
+		if !c.isLocal(expr.Value) {
+			c.refs = append(c.refs, expr)
+		}
+	case *luaast.AttrGetExpr:
+		c.expr(expr.Object)
+		c.expr(expr.Key)
+	case *luaast.TableExpr:
+		for _, field := range expr.Fields {
+			c.expr(field.Key)
+			c.expr(field.Value)
+		}
+	case *luaast.FuncCallExpr:
+		c.expr(expr.Func)
+		c.expr(expr.Receiver)
+		c.exprs(expr.Args)
+	case *luaast.LogicalOpExpr:
+		c.expr(expr.Lhs)
+		c.expr(expr.Rhs)
+	case *luaast.RelationalOpExpr:
+		c.expr(expr.Lhs)
+		c.expr(expr.Rhs)
+	case *luaast.StringConcatOpExpr:
+		c.expr(expr.Lhs)
+		c.expr(expr.Rhs)
+	case *luaast.ArithmeticOpExpr:
+		c.expr(expr.Lhs)
+		c.expr(expr.Rhs)
+	case *luaast.UnaryMinusOpExpr:
+		c.expr(expr.Expr)
+	case *luaast.UnaryNotOpExpr:
+		c.expr(expr.Expr)
+	case *luaast.UnaryLenOpExpr:
+		c.expr(expr.Expr)
+	case *luaast.FunctionExpr:
+		c.function(expr, false)
+	}
+}
+
+func (c *globalsChecker) function(fn *luaast.FunctionExpr, method bool) {
+	c.open()
+	if method {
+		c.declare("self")
+	}
+	c.declare(fn.ParList.Names...)
+	c.stmts(fn.Stmts)
+	c.close()
+}
+
+type luaTokenKind int
+
+const (
+	tokSpace luaTokenKind = iota // whitespaces and comments
+	tokName
+	tokNumber
+	tokString
+	tokOp
+)
+
+type luaToken struct {
+	kind luaTokenKind
+	text string
+	line int
+}
+
+// toLua51 checks that the code only uses the syntax supported by the target
+// dialect and rewrites the syntax that is not available in Lua 5.1 so the
+// code can be parsed by gopher-lua. The rewritten code is not equivalent but
+// it has the same structure and line numbers.
+func toLua51(code string, target LuaVersion) (string, int, error) {
+	var sb strings.Builder
+	var prev *luaToken
+	inLabel := false
+	afterGoto := false
+
+	for _, tok := range luaTokenize(code) {
+		text := tok.text
+
+		switch {
+		case tok.kind == tokName && tok.text == "goto":
+			if !target.hasGoto() {
+				return "", tok.line, fmt.Errorf("'goto' is not supported by %s", target)
+			}
+			text = "do"
+			afterGoto = true
+		case tok.kind == tokName && afterGoto:
+			text = "end"
+			afterGoto = false
+		case tok.kind == tokName && inLabel:
+			text = " "
+		case tok.kind == tokOp && tok.text == "::":
+			if !target.hasGoto() {
+				return "", tok.line, fmt.Errorf("labels are not supported by %s", target)
+			}
+			if inLabel {
+				text = " end "
+			} else {
+				text = " do "
+			}
+			inLabel = !inLabel
+		case tok.kind == tokOp && (tok.text == "//" || tok.text == "&" || tok.text == "|" ||
+			tok.text == "<<" || tok.text == ">>" || tok.text == "~"):
+			if !target.hasIntegers() {
+				return "", tok.line, fmt.Errorf("operator '%s' is not supported by %s", tok.text, target)
+			}
+			switch {
+			case tok.text == "//":
+				text = "/"
+			case tok.text == "~" && !isOperandEnd(prev):
+				text = "-"
+			default:
+				text = "+"
+			}
+		}
+
+		if tok.kind != tokSpace {
+			prev = tok
+		}
+		sb.WriteString(text)
+	}
+
+	return sb.String(), 0, nil
+}
+
+// isOperandEnd returns true if the token can be the last token of an
+// operand, which makes the following operator a binary operator.
+func isOperandEnd(tok *luaToken) bool {
+	if tok == nil {
+		return false
+	}
+
+	switch tok.kind {
+	case tokNumber, tokString:
+		return true
+	case tokName:
+		return !luaKeywords[tok.text] || tok.text == "true" || tok.text == "false" || tok.text == "nil"
+	}
+
+	return tok.text == ")" || tok.text == "]" || tok.text == "}" || tok.text == "..."
+}
+
+// luaTokenize splits Lua code into tokens. Concatenating all the tokens
+// produces the original code.
+func luaTokenize(code string) []*luaToken {
+	var tokens []*luaToken
+	line := 1
+
+	for pos := 0; pos < len(code); {
+		kind := tokOp
+		end := pos + 1
+		c := code[pos]
+
+		switch {
+		case c == ' ' || c == '\t' || c == '\r' || c == '\n' || c == '\f' || c == '\v':
+			kind = tokSpace
+			for end < len(code) && strings.IndexByte(" \t\r\n\f\v", code[end]) >= 0 {
+				end++
+			}
+		case strings.HasPrefix(code[pos:], "--"):
+			kind = tokSpace
+			if n := longBracketEnd(code, pos+2); n > 0 {
+				end = n
+			} else if n := strings.IndexByte(code[pos:], '\n'); n >= 0 {
+				end = pos + n
+			} else {
+				end = len(code)
+			}
+		case c == '[' && longBracketEnd(code, pos) > 0:
+			kind = tokString
+			end = longBracketEnd(code, pos)
+		case c == '"' || c == '\'':
+			kind = tokString
+			for end < len(code) && code[end] != c {
+				if code[end] == '\\' {
+					end++
+				}
+				end++
+			}
+			end++
+		case isDigit(c) || (c == '.' && pos+1 < len(code) && isDigit(code[pos+1])):
+			kind = tokNumber
+			exp := "eE"
+			if strings.HasPrefix(code[pos:], "0x") || strings.HasPrefix(code[pos:], "0X") {
+				exp = "pP"
+			}
+			for end < len(code) {
+				if isLuaNameChar(rune(code[end])) || code[end] == '.' {
+					end++
+				} else if (code[end] == '+' || code[end] == '-') && strings.IndexByte(exp, code[end-1]) >= 0 {
+					end++
+				} else {
+					break
+				}
+			}
+		case isLuaNameChar(rune(c)):
+			kind = tokName
+			for end < len(code) && isLuaNameChar(rune(code[end])) {
+				end++
+			}
+		case strings.HasPrefix(code[pos:], "..."):
+			end = pos + 3
+		default:
+			for _, op := range []string{"..", "==", "~=", "<=", ">=", "<<", ">>", "//", "::"} {
+				if strings.HasPrefix(code[pos:], op) {
+					end = pos + 2
+					break
+				}
+			}
+		}
+
+		if end > len(code) {
+			end = len(code)
+		}
+
+		text := code[pos:end]
+		tokens = append(tokens, &luaToken{kind: kind, text: text, line: line})
+		line += strings.Count(text, "\n")
+		pos = end
+	}
+
+	return tokens
+}
+
+// longBracketEnd returns the end position of the long bracket
+// ("[==[ ... ]==]") that starts at the position, or 0 if there's no valid
+// long bracket.
+func longBracketEnd(code string, pos int) int {
+	if pos >= len(code) || code[pos] != '[' {
+		return 0
+	}
+
+	level := 0
+	for pos+1+level < len(code) && code[pos+1+level] == '=' {
+		level++
+	}
+	if pos+1+level >= len(code) || code[pos+1+level] != '[' {
+		return 0
+	}
+
+	close := "]" + strings.Repeat("=", level) + "]"
+	n := strings.Index(code[pos+2+level:], close)
+	if n < 0 {
+		return len(code)
+	}
+
+	return pos + 2 + level + n + len(close)
+}
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
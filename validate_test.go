@@ -0,0 +1,60 @@
+package tengo2lua
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/d5/tengo/assert"
+	"github.com/d5/tengo/compiler/source"
+)
+
+// validateLua validates the Lua code as if it were generated from the second
+// line of a Tengo script.
+func validateLua(t *testing.T, code string, opts *Options) error {
+	tr := NewTranspiler([]byte("a:=1\nif a>0 {\n  a=2\n}"), opts)
+	_, err := tr.parse()
+	assert.NoError(t, err)
+
+	linePos := make([]source.Pos, strings.Count(code, "\n")+1)
+	for idx := range linePos {
+		linePos[idx] = tr.file.FileSetPos(5)
+	}
+	return tr.validate(code, linePos)
+}
+
+func validateError(t *testing.T, code string, opts *Options, expected string) {
+	err := validateLua(t, code, opts)
+	if assert.Error(t, err) {
+		assert.True(t, strings.Contains(err.Error(), expected), "expected: %s, got: %s", expected, err.Error())
+	}
+}
+
+func TestValidate(t *testing.T) {
+	opts := DefaultOptions()
+
+	// invalid code
+	validateError(t, "local a = 1\n! a = 2", opts, "invalid Lua code generated")
+	validateError(t, "local a = 1\n! a = 2", opts, "at script:2:1")
+
+	// undeclared globals
+	validateError(t, "local a = 1\nfoo()", opts, "reference to undeclared global 'foo'")
+	validateError(t, "local a = 1\nfoo()", opts, "at script:2:1")
+	validateError(t, "local f = function() return f() end", opts, "reference to undeclared global 'f'")
+	assert.NoError(t, validateLua(t, "local f\nf = function() return f() end", opts))
+	assert.NoError(t, validateLua(t, "foo = 1\nreturn foo", opts))
+	opts.AllowedGlobals = []string{"foo"}
+	assert.NoError(t, validateLua(t, "foo()", opts))
+
+	// syntax constraints of the target
+	opts = DefaultOptions()
+	validateError(t, "local x = 1//2", opts, "operator '//' is not supported by Lua 5.1")
+	validateError(t, "goto l ::l::", opts, "'goto' is not supported by Lua 5.1")
+	opts.Target = Lua53
+	assert.NoError(t, validateLua(t, "local x = 1//2", opts))
+	assert.NoError(t, validateLua(t, "goto l ::l::", opts))
+
+	// standard library of the target
+	validateError(t, "unpack({})", opts, "reference to undeclared global 'unpack'")
+	opts.Target = LuaJIT
+	assert.NoError(t, validateLua(t, "unpack({})", opts))
+}
@@ -0,0 +1,145 @@
+package tengo2lua
+
+import (
+	"github.com/d5/tengo/compiler/ast"
+	"github.com/d5/tengo/compiler/token"
+)
+
+// inspect traverses Tengo AST in depth-first order. It calls f for each node
+// and, if f returns true, continues with the children of the node.
+func inspect(node ast.Node, f func(ast.Node) bool) {
+	if isNilNode(node) || !f(node) {
+		return
+	}
+
+	for _, child := range children(node) {
+		inspect(child, f)
+	}
+}
+
+// children returns the child nodes of a Tengo AST node in source order.
+func children(node ast.Node) []ast.Node {
+	var nodes []ast.Node
+	add := func(children ...ast.Node) {
+		for _, child := range children {
+			if !isNilNode(child) {
+				nodes = append(nodes, child)
+			}
+		}
+	}
+
+	switch node := node.(type) {
+	case *ast.File:
+		for _, stmt := range node.Stmts {
+			add(stmt)
+		}
+	case *ast.BlockStmt:
+		for _, stmt := range node.Stmts {
+			add(stmt)
+		}
+	case *ast.ExprStmt:
+		add(node.Expr)
+	case *ast.IncDecStmt:
+		add(node.Expr)
+	case *ast.AssignStmt:
+		for _, expr := range node.LHS {
+			add(expr)
+		}
+		for _, expr := range node.RHS {
+			add(expr)
+		}
+	case *ast.ReturnStmt:
+		add(node.Result)
+	case *ast.ExportStmt:
+		add(node.Result)
+	case *ast.IfStmt:
+		add(node.Init, node.Cond, node.Body, node.Else)
+	case *ast.ForStmt:
+		add(node.Init, node.Cond, node.Post, node.Body)
+	case *ast.ForInStmt:
+		add(node.Key, node.Value, node.Iterable, node.Body)
+	case *ast.ParenExpr:
+		add(node.Expr)
+	case *ast.BinaryExpr:
+		add(node.LHS, node.RHS)
+	case *ast.UnaryExpr:
+		add(node.Expr)
+	case *ast.SelectorExpr:
+		add(node.Expr, node.Sel)
+	case *ast.IndexExpr:
+		add(node.Expr, node.Index)
+	case *ast.SliceExpr:
+		add(node.Expr, node.Low, node.High)
+	case *ast.CallExpr:
+		add(node.Func)
+		for _, arg := range node.Args {
+			add(arg)
+		}
+	case *ast.ArrayLit:
+		for _, elem := range node.Elements {
+			add(elem)
+		}
+	case *ast.MapLit:
+		for _, elem := range node.Elements {
+			add(elem)
+		}
+	case *ast.MapElementLit:
+		add(node.Value)
+	case *ast.FuncLit:
+		for _, param := range node.Type.Params.List {
+			add(param)
+		}
+		add(node.Body)
+	case *ast.CondExpr:
+		add(node.Cond, node.True, node.False)
+	case *ast.ErrorExpr:
+		add(node.Expr)
+	case *ast.ImmutableExpr:
+		add(node.Expr)
+	}
+
+	return nodes
+}
+
+// refersTo returns true if the node contains an identifier with the name.
+func refersTo(node ast.Node, name string) bool {
+	found := false
+	inspect(node, func(n ast.Node) bool {
+		if ident, ok := n.(*ast.Ident); ok && ident.Name == name {
+			found = true
+		}
+		return !found
+	})
+	return found
+}
+
+// isNilNode returns true if the node is nil or a nil pointer.
+func isNilNode(node ast.Node) bool {
+	switch node := node.(type) {
+	case nil:
+		return true
+	case *ast.BlockStmt:
+		return node == nil
+	case *ast.Ident:
+		return node == nil
+	}
+	return node == nil
+}
+
+// usesContinue returns true if the loop body contains a "continue" statement
+// for the loop itself (not for a nested loop).
+func usesContinue(body *ast.BlockStmt) bool {
+	found := false
+	inspect(body, func(node ast.Node) bool {
+		switch node := node.(type) {
+		case *ast.ForStmt, *ast.ForInStmt, *ast.FuncLit:
+			return false
+		case *ast.BranchStmt:
+			if node.Token == token.Continue {
+				found = true
+			}
+		}
+		return !found
+	})
+	return found
+}